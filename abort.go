@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// statusError is a non-2xx answer that didn't come with a SinkResult, such
+// as a failed lookup.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "lookup returned " + e.status
+}
+
+// pushGuard watches one target's outcomes and decides when to stop,
+// following config.Abort. Once it has a reason it keeps it.
+type pushGuard struct {
+	mu sync.Mutex
+	// window holds whether each of the last config.Abort.Window requests
+	// failed.
+	window         []bool
+	next           int
+	filled         int
+	failedInWindow int
+	consecutive5xx int
+	reason         string
+}
+
+func newPushGuard() *pushGuard {
+	g := &pushGuard{}
+	if config.Abort.Window > 0 {
+		g.window = make([]bool, config.Abort.Window)
+	}
+	return g
+}
+
+// observe counts one doc's outcome. Docs the target wasn't asked about,
+// such as unchanged ones, neither fail nor break a run of 5xx responses.
+func (g *pushGuard) observe(o pushOutcome) {
+	if !o.sent {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reason != "" {
+		return
+	}
+	if config.Abort.OnAuthError && (o.code == http.StatusUnauthorized || o.code == http.StatusForbidden) {
+		g.reason = "auth error, " + o.status
+		return
+	}
+
+	if o.code >= 500 {
+		g.consecutive5xx++
+	} else {
+		g.consecutive5xx = 0
+	}
+	if config.Abort.MaxConsecutive5xx > 0 && g.consecutive5xx > config.Abort.MaxConsecutive5xx {
+		g.reason = fmt.Sprintf("%d consecutive 5xx responses", g.consecutive5xx)
+		return
+	}
+
+	if g.window == nil {
+		return
+	}
+	failed := pushFailed(o)
+	if g.filled == len(g.window) && g.window[g.next] {
+		g.failedInWindow--
+	}
+	g.window[g.next] = failed
+	if failed {
+		g.failedInWindow++
+	}
+	g.next = (g.next + 1) % len(g.window)
+	if g.filled < len(g.window) {
+		g.filled++
+	}
+	if g.filled == len(g.window) && config.Abort.MaxFailureRate > 0 {
+		if rate := float64(g.failedInWindow) / float64(len(g.window)); rate > config.Abort.MaxFailureRate {
+			g.reason = fmt.Sprintf("%d of the last %d requests failed", g.failedInWindow, len(g.window))
+		}
+	}
+}
+
+// aborted returns why the push should stop, or "" to go on.
+func (g *pushGuard) aborted() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reason
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// buildFixture runs buildJson over testdata/feed in a scratch directory
+// and returns that directory.
+func buildFixture(t *testing.T) string {
+	testdata, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		categoryMap, markets, media, swatches, manifestByName, selection = nil, nil, nil, nil, nil, nil
+	})
+	config = defaultConfig()
+	config.DataDir = filepath.Join(testdata, "feed")
+	config.Taxonomy.File = filepath.Join(testdata, "Taxonomy.csv")
+	config.Markets.OverrideFile = filepath.Join(testdata, "MarketOverrides.csv")
+	config.Media.Dir = filepath.Join(testdata, "media")
+	config.Swatches.Dir = filepath.Join(testdata, "swatches")
+	categoryMap, markets, media, swatches, manifestByName, selection = nil, nil, nil, nil, nil, nil
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	buildJson()
+	return dir
+}
+
+// checkGolden compares got with testdata/golden/name, or rewrites it with
+// -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -run Golden -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from %s; if the change is intended, run go test -run Golden -update and review the diff\n%s", name, path, firstDifference(got, want))
+	}
+}
+
+// firstDifference shows the first line that differs.
+func firstDifference(got []byte, want []byte) string {
+	g, w := bytes.Split(got, []byte("\n")), bytes.Split(want, []byte("\n"))
+	for i := 0; i < len(g) || i < len(w); i++ {
+		var gl, wl []byte
+		if i < len(g) {
+			gl = g[i]
+		}
+		if i < len(w) {
+			wl = w[i]
+		}
+		if !bytes.Equal(gl, wl) {
+			return "line " + strconv.Itoa(i+1) + ":\n  got:  " + string(gl) + "\n  want: " + string(wl)
+		}
+	}
+	return ""
+}
+
+func TestBuildJsonGolden(t *testing.T) {
+	dir := buildFixture(t)
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// out.json is written on one line; the golden copy is indented so a
+	// change shows up as a readable diff.
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, raw, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	pretty.WriteByte('\n')
+	checkGolden(t, "out.json", pretty.Bytes())
+
+	for _, report := range []string{"unmappedCategories.csv", "missingMedia.csv"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, report))
+		if os.IsNotExist(err) {
+			got = nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, report, got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// canarySample picks up to n of the docs at indices, the ones this run
+// will send, to push first. Docs that bring a category or manufacturer not
+// yet in the sample come first, then new category and manufacturer pairs,
+// then the rest in feed order, so a bad mapping for either shows up before
+// the full push.
+func canarySample(docs Docs, indices []int, n int) []int {
+	categories := make(map[string]bool)
+	manufacturers := make(map[string]bool)
+	pairs := make(map[string]bool)
+	var first, second, rest []int
+	for _, s := range indices {
+		cat := docs[s].General.Category
+		manuf := strings.ToLower(docs[s].General.Manufacturer)
+		pair := cat + "|" + manuf
+		switch {
+		case !categories[cat] || !manufacturers[manuf]:
+			first = append(first, s)
+		case !pairs[pair]:
+			second = append(second, s)
+		default:
+			rest = append(rest, s)
+		}
+		categories[cat] = true
+		manufacturers[manuf] = true
+		pairs[pair] = true
+	}
+	sample := append(append(first, second...), rest...)
+	if len(sample) > n {
+		sample = sample[:n]
+	}
+	return sample
+}
+
+// runCanary pushes the sample, reads back what was sent to canary.csv and
+// returns an error when more than config.Canary.MaxFailureRate of it
+// failed and the push should not go on.
+func runCanary(run *targetRun, sample []int, state *PushState, snap *catalogSnapshot, opts pushOptions, failures *failureLog) error {
+	name := run.sink.Name()
+	fmt.Println("pushing a canary of", len(sample), "docs to", name)
+	pushedBefore := len(run.pushed)
+	failed, err := pushIndices(run, sample, state, snap, opts, failures)
+	if err != nil {
+		// An abort leaves part of the sample untried; report what was tried.
+		tried := 0
+		for _, s := range sample {
+			if _, ok := run.results[s]; ok {
+				tried++
+			}
+		}
+		run.canaryChecked, run.canaryFailed = tried, failed
+		return err
+	}
+	if !opts.dryRun {
+		canaryPushed := append([]pushedDoc(nil), run.pushed[pushedBefore:]...)
+		_, mismatched := verifyPushed(run.sink, run.docs, canaryPushed, "canary.csv")
+		failed += mismatched
+	}
+	run.canaryChecked, run.canaryFailed = len(sample), failed
+	if len(sample) == 0 || float64(failed)/float64(len(sample)) <= config.Canary.MaxFailureRate {
+		fmt.Println("canary passed on", name+",", failed, "of", len(sample), "failed")
+		return nil
+	}
+	err = fmt.Errorf("canary failed, %d of %d docs did not push or read back as sent", failed, len(sample))
+	if opts.canaryOnFailure == "pause" && confirm(name+": "+err.Error()+". Continue with the rest? (y/n): ") {
+		return nil
+	}
+	return err
+}
+
+// promptMu keeps targets pushed side by side from asking at once.
+var promptMu sync.Mutex
+
+func confirm(question string) bool {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	fmt.Print(question)
+	var answer string
+	fmt.Scanln(&answer)
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Config holds the settings that are not part of the CRS feed itself.
+// It is read from config.json when present; every field falls back to the
+// value the tool used before it was configurable.
+type Config struct {
+	// DataDir is the CRS data drop the feed tables are read from.
+	DataDir  string `json:"dataDir"`
+	Taxonomy struct {
+		// File is a CSV of Category,Subcategory rows describing the
+		// target's category tree.
+		File string `json:"file"`
+		// Url, when set, is fetched instead of File.
+		Url string `json:"url"`
+	} `json:"taxonomy"`
+	Markets struct {
+		// Default is the countries a model is sold in unless overridden.
+		Default []string `json:"default"`
+		// OverrideFile is a CSV of Manufacturer,Category,Countries rows.
+		OverrideFile string `json:"overrideFile"`
+	} `json:"markets"`
+	Images struct {
+		// BaseUrl is the CDN prefix of every image link.
+		BaseUrl string `json:"baseUrl"`
+		// Folders maps an image type (hero, floorplan, gallery) to its size
+		// variants and the CDN folder each one lives in.
+		Folders map[string]map[string]string `json:"folders"`
+		// DefaultVariant is the size used for Images[].src.
+		DefaultVariant string `json:"defaultVariant"`
+		// Manifest, when set, is the "images process" manifest; images it
+		// lists link to their generated variants instead of Folders.
+		Manifest string `json:"manifest"`
+	} `json:"images"`
+	ImageFilter struct {
+		// MinYear and MaxYear keep images whose path carries a model year
+		// in range; 0 leaves that end open and both 0 disables the check.
+		MinYear int `json:"minYear"`
+		MaxYear int `json:"maxYear"`
+		// Manufacturers keeps every image whose path names one of them.
+		Manufacturers []string `json:"manufacturers"`
+	} `json:"imageFilter"`
+	ImageSorter struct {
+		// Rules are tried in order; see SortRule.
+		Rules []SortRule `json:"rules"`
+	} `json:"imageSorter"`
+	ImageProcessing struct {
+		// Output is the tree "images process" writes, one folder per variant.
+		Output string `json:"output"`
+		// Variants maps a variant name to its size.
+		Variants map[string]ImageVariant `json:"variants"`
+	} `json:"imageProcessing"`
+	Swatches struct {
+		// Dir holds <OEM>/<Model>_<Color> swatch images.
+		Dir string `json:"dir"`
+		// MappingFile is an optional CSV of TrimId,Manufacturer,Model,ColorName,File.
+		MappingFile string `json:"mappingFile"`
+		// Folder is the CDN folder the swatch tree is uploaded to.
+		Folder string `json:"folder"`
+	} `json:"swatches"`
+	Media struct {
+		// Dir holds the video and attachment files, either named by the
+		// tables or laid out as <TrimId>/videos and <TrimId>/attachments.
+		Dir string `json:"dir"`
+		// VideosFile and AttachmentsFile are optional CSVs of
+		// TrimId,Url,File,Description,LongDescription, relative to DataDir.
+		VideosFile      string `json:"videosFile"`
+		AttachmentsFile string `json:"attachmentsFile"`
+		// Folder is the CDN folder Dir is uploaded to.
+		Folder string `json:"folder"`
+	} `json:"media"`
+	Validation struct {
+		// MinYear and MaxYear bound general.year; MaxYear 0 means two years
+		// from now.
+		MinYear int `json:"minYear"`
+		MaxYear int `json:"maxYear"`
+		// Quarantine is where docs failing validation are written.
+		Quarantine string `json:"quarantine"`
+	} `json:"validation"`
+	State struct {
+		// File keeps the remote _id and content hash of every pushed doc.
+		File string `json:"file"`
+	} `json:"state"`
+	Nebulous struct {
+		// TokenUrl issues the client credentials token every target takes.
+		TokenUrl     string `json:"tokenUrl"`
+		ClientId     string `json:"clientId"`
+		ClientSecret string `json:"clientSecret"`
+	} `json:"nebulous"`
+	// Targets are the destinations docs can be pushed to, by name. The
+	// interactive prompt picks <api>-<stage|prod>.
+	Targets map[string]TargetConfig `json:"targets"`
+	Target  struct {
+		// PageSize is the page size used when listing every model.
+		PageSize int `json:"pageSize"`
+		// TimeoutSeconds bounds every request to a target or the token
+		// endpoint; 0 waits forever.
+		TimeoutSeconds float64 `json:"timeoutSeconds"`
+	} `json:"target"`
+	Push struct {
+		// Targets are pushed to when -target isn't given; empty asks.
+		Targets []string `json:"targets"`
+		// Workers is how many docs are sent to each target at a time.
+		Workers int `json:"workers"`
+	} `json:"push"`
+	Canary struct {
+		// MaxFailureRate is the share of the canary sample, 0 to 1, that may
+		// fail to push or read back before the push stops.
+		MaxFailureRate float64 `json:"maxFailureRate"`
+		// OnFailure is abort, or pause to ask whether to go on.
+		OnFailure string `json:"onFailure"`
+	} `json:"canary"`
+	Abort struct {
+		// Window is how many of the latest docs MaxFailureRate looks at.
+		Window int `json:"window"`
+		// MaxFailureRate stops a target once more than this share, 0 to 1,
+		// of the last Window docs failed; 0 turns the rule off.
+		MaxFailureRate float64 `json:"maxFailureRate"`
+		// OnAuthError stops a target on its first 401 or 403.
+		OnAuthError bool `json:"onAuthError"`
+		// MaxConsecutive5xx stops a target after more 5xx responses in a
+		// row than this; 0 turns the rule off.
+		MaxConsecutive5xx int `json:"maxConsecutive5xx"`
+	} `json:"abort"`
+	Runs struct {
+		// Dir keeps, per push run, the docs each target accepted.
+		Dir string `json:"dir"`
+	} `json:"runs"`
+	Retire struct {
+		// Mode is what "retire" does with records no longer in the feed:
+		// report, inactive or delete.
+		Mode string `json:"mode"`
+		// MaxChanges caps how many records one run may mark or delete.
+		MaxChanges int `json:"maxChanges"`
+		// InactivePatch is the PATCH body that marks a record inactive.
+		InactivePatch string `json:"inactivePatch"`
+	} `json:"retire"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	var c Config
+	c.DataDir = "Data_2019_03_01"
+	c.Taxonomy.File = "Taxonomy.csv"
+	c.Markets.Default = []string{"US", "CA"}
+	c.Markets.OverrideFile = "MarketOverrides.csv"
+	c.Images.BaseUrl = "https://s3.amazonaws.com/cws-cdn-east/crs-ps-images/"
+	c.Images.Folders = map[string]map[string]string{
+		imageHero:      {"800": "800x400"},
+		imageFloorplan: {"800": "Floorplan800"},
+		imageGallery:   {"800": "gallery"},
+	}
+	c.Images.DefaultVariant = "800"
+	c.ImageSorter.Rules = defaultSortRules
+	c.ImageProcessing.Output = "processed_images"
+	c.ImageProcessing.Variants = map[string]ImageVariant{
+		"thumbnail": {Width: 200, Height: 100},
+		"800":       {Width: 800, Height: 400},
+		"full":      {},
+	}
+	c.Swatches.Dir = "all_images/ColorSwatches"
+	c.Swatches.MappingFile = "ColorSwatchMapping.csv"
+	c.Swatches.Folder = "ColorSwatches"
+	c.Media.Dir = "media"
+	c.Media.VideosFile = "PS_Videos.csv"
+	c.Media.AttachmentsFile = "PS_Attachments.csv"
+	c.Media.Folder = "media"
+	c.Validation.MinYear = 1980
+	c.Validation.Quarantine = "quarantine.json"
+	c.State.File = "pushState.json"
+	c.Nebulous.TokenUrl = "https://apis.traderonline.com/vLatest/token"
+	c.Nebulous.ClientId = "blackbook"
+	c.Nebulous.ClientSecret = "#ZoDDn08ZlQjncScAfs1?3URoX8JPDZN"
+	c.Targets = map[string]TargetConfig{
+		"discordia-stage": {Type: "discordia", Url: "http://127.0.0.1:5000/v1/model/", ModelsUrl: "http://127.0.0.1:5000/v1/models"},
+		"discordia-prod":  {Type: "discordia", Url: "https://discordia.blackbook.tilabs.tech/v1/model/", ModelsUrl: "https://discordia.blackbook.tilabs.tech/v1/models"},
+		"igneous-stage":   {Type: "igneous", Url: "https://api.stage.cwsplatform.com/specs", ModelsUrl: "https://api.stage.cwsplatform.com/specs"},
+		"igneous-prod":    {Type: "igneous", Url: "https://api.prod.cwsplatform.com/specs", ModelsUrl: "https://api.prod.cwsplatform.com/specs"},
+	}
+	c.Target.PageSize = 100
+	c.Target.TimeoutSeconds = 60
+	c.Push.Workers = 4
+	c.Canary.OnFailure = "abort"
+	c.Abort.Window = 50
+	c.Abort.MaxFailureRate = 0.5
+	c.Abort.OnAuthError = true
+	c.Abort.MaxConsecutive5xx = 10
+	c.Runs.Dir = "runs"
+	c.Retire.Mode = "report"
+	c.Retire.MaxChanges = 25
+	c.Retire.InactivePatch = `{"meta":{"source":"CRS","active":false}}`
+	return c
+}
+
+// dataFile returns the path of a feed table in config.DataDir.
+func dataFile(name string) string {
+	return filepath.Join(config.DataDir, name)
+}
+
+// loadConfig reads path over the defaults. A missing file is not an error.
+func loadConfig(path string) Config {
+	c := defaultConfig()
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		log.Fatal("Unable to parse " + path + ", the reported error was: " + err.Error())
+	}
+	return c
+}
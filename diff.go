@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FeedChange is one difference between two builds of the feed.
+type FeedChange struct {
+	Change       string
+	TrimId       string
+	Manufacturer string
+	Year         int
+	Model        string
+	Field        string
+	Old          string
+	New          string
+}
+
+var specsMapType = reflect.TypeOf(map[string]Specs{})
+
+// specSections returns the spec maps of a doc keyed by their json name.
+func specSections(docs Docs, s int) map[string]map[string]Specs {
+	sections := make(map[string]map[string]Specs)
+	v := reflect.ValueOf(docs[s])
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type != specsMapType {
+			continue
+		}
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if m := v.Field(i).Interface().(map[string]Specs); len(m) > 0 {
+			sections[name] = m
+		}
+	}
+	return sections
+}
+
+// buildFeed builds docs from another data directory, resetting everything
+// buildDocs caches from the previous one.
+func buildFeed(dir string) feedBuild {
+	config.DataDir = dir
+	categoryMap = nil
+	media = nil
+	return buildDocs()
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffFeeds compares two builds trim by trim.
+func diffFeeds(oldBuild feedBuild, newBuild feedBuild) []FeedChange {
+	oldIdx := make(map[string]int)
+	for i, id := range oldBuild.trimIds {
+		oldIdx[id] = i
+	}
+	newIdx := make(map[string]int)
+	for i, id := range newBuild.trimIds {
+		newIdx[id] = i
+	}
+	ids := make(map[string]bool)
+	for id := range oldIdx {
+		ids[id] = true
+	}
+	for id := range newIdx {
+		ids[id] = true
+	}
+
+	var changes []FeedChange
+	for _, id := range sortedKeys(ids) {
+		o, inOld := oldIdx[id]
+		n, inNew := newIdx[id]
+		if !inOld || !inNew {
+			docs, i, change := newBuild.docs, n, "added"
+			if !inNew {
+				docs, i, change = oldBuild.docs, o, "removed"
+			}
+			changes = append(changes, FeedChange{Change: change, TrimId: id, Manufacturer: docs[i].General.Manufacturer, Year: docs[i].General.Year, Model: docs[i].General.Model})
+			continue
+		}
+		od, nd := oldBuild.docs[o].General, newBuild.docs[n].General
+		add := func(change string, field string, oldVal string, newVal string) {
+			changes = append(changes, FeedChange{Change: change, TrimId: id, Manufacturer: nd.Manufacturer, Year: nd.Year, Model: nd.Model, Field: field, Old: oldVal, New: newVal})
+		}
+
+		if od.Msrp != nd.Msrp {
+			add("msrp", "general.msrp", strconv.FormatFloat(od.Msrp, 'f', -1, 64), strconv.FormatFloat(nd.Msrp, 'f', -1, 64))
+		}
+		if od.Category != nd.Category {
+			add("category", "general.category", od.Category, nd.Category)
+		}
+		if od.Subcategory != nd.Subcategory {
+			add("category", "general.subcategory", od.Subcategory, nd.Subcategory)
+		}
+
+		oldSpecs, newSpecs := specSections(oldBuild.docs, o), specSections(newBuild.docs, n)
+		fields := make(map[string]bool)
+		for section, m := range oldSpecs {
+			for key := range m {
+				fields[section+"."+key] = true
+			}
+		}
+		for section, m := range newSpecs {
+			for key := range m {
+				fields[section+"."+key] = true
+			}
+		}
+		for _, field := range sortedKeys(fields) {
+			parts := strings.SplitN(field, ".", 2)
+			oldSpec, newSpec := oldSpecs[parts[0]][parts[1]], newSpecs[parts[0]][parts[1]]
+			if oldSpec.Desc != newSpec.Desc {
+				add("spec", field, oldSpec.Desc, newSpec.Desc)
+			}
+		}
+
+		images := make(map[string]int)
+		for _, img := range oldBuild.docs[o].Images {
+			images[img.Src] |= 1
+		}
+		for _, img := range newBuild.docs[n].Images {
+			images[img.Src] |= 2
+		}
+		srcs := make([]string, 0, len(images))
+		for src := range images {
+			srcs = append(srcs, src)
+		}
+		sort.Strings(srcs)
+		for _, src := range srcs {
+			switch images[src] {
+			case 1:
+				add("image", "images", src, "")
+			case 2:
+				add("image", "images", "", src)
+			}
+		}
+	}
+	return changes
+}
+
+func writeDiffCsv(path string, changes []FeedChange) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"Change", "TrimId", "Manufacturer", "Year", "Model", "Field", "Old", "New"})
+	for _, c := range changes {
+		writer.Write([]string{c.Change, c.TrimId, c.Manufacturer, strconv.Itoa(c.Year), c.Model, c.Field, c.Old, c.New})
+	}
+	writer.Flush()
+}
+
+var diffTemplate = template.Must(template.New("diff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Feed diff</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+.added { background: #e6ffed; } .removed { background: #ffeef0; }
+</style>
+</head>
+<body>
+<h1>Feed diff</h1>
+<p>{{.Old}} &rarr; {{.New}}</p>
+<ul>{{range .Counts}}<li>{{.Change}}: {{.Count}}</li>{{end}}</ul>
+<table>
+<tr><th>Change</th><th>TrimId</th><th>Manufacturer</th><th>Year</th><th>Model</th><th>Field</th><th>Old</th><th>New</th></tr>
+{{range .Changes}}<tr class="{{.Change}}"><td>{{.Change}}</td><td>{{.TrimId}}</td><td>{{.Manufacturer}}</td><td>{{.Year}}</td><td>{{.Model}}</td><td>{{.Field}}</td><td>{{.Old}}</td><td>{{.New}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func writeDiffHtml(path string, oldDir string, newDir string, changes []FeedChange) {
+	type count struct {
+		Change string
+		Count  int
+	}
+	link := make(map[string]int)
+	for _, c := range changes {
+		link = countStatus(c.Change, link)
+	}
+	var counts []count
+	for change, n := range link {
+		counts = append(counts, count{change, n})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Change < counts[j].Change })
+
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	err = diffTemplate.Execute(f, struct {
+		Old, New string
+		Counts   []count
+		Changes  []FeedChange
+	}{oldDir, newDir, counts, changes})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// diffCommand builds two CRS data drops and reports what changed between
+// them, for review before the new drop is pushed.
+func diffCommand(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	oldDir := fs.String("old", "", "previous data directory")
+	newDir := fs.String("new", config.DataDir, "new data directory")
+	out := fs.String("out", "diff", "report name; writes <out>.csv and <out>.html")
+	filterFlags := addTrimFilterFlags(fs)
+	fs.Parse(args)
+	selection = filterFlags.filter()
+	if *oldDir == "" {
+		fmt.Println("usage: diff -old <dir> [-new <dir>] [-out diff]")
+		os.Exit(2)
+	}
+
+	oldBuild := buildFeed(*oldDir)
+	newBuild := buildFeed(*newDir)
+	changes := diffFeeds(oldBuild, newBuild)
+	writeDiffCsv(*out+".csv", changes)
+	writeDiffHtml(*out+".html", *oldDir, *newDir, changes)
+	fmt.Println(len(changes), "changes, see", *out+".csv", "and", *out+".html")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// discordiaSink pushes docs to the Discordia model API as JSON.
+type discordiaSink struct {
+	name  string
+	cfg   TargetConfig
+	token string
+}
+
+func (d *discordiaSink) Name() string { return d.name }
+
+func (d *discordiaSink) headers() map[string]string {
+	return map[string]string{"Content-Type": "application/json", "Authorization": d.token}
+}
+
+// discordiaError turns {"error":true,"msg":{"general.manufacturer":["Manufacturer was not found."]}}
+// into "general.manufacturer: Manufacturer was not found.".
+func discordiaError(r SinkResult) SinkResult {
+	if r.Err != nil || (r.Code >= 200 && r.Code <= 299) {
+		return r
+	}
+	var body struct {
+		Error interface{}     `json:"error"`
+		Msg   json.RawMessage `json:"msg"`
+	}
+	if json.Unmarshal([]byte(r.Body), &body) != nil || len(body.Msg) == 0 {
+		r.Err = errors.New(r.Status + ": " + r.Body)
+		return r
+	}
+	var fields map[string][]string
+	if json.Unmarshal(body.Msg, &fields) == nil {
+		var parts []string
+		for field, msgs := range fields {
+			parts = append(parts, field+": "+strings.Join(msgs, " "))
+		}
+		sort.Strings(parts)
+		r.Err = errors.New(strings.Join(parts, "; "))
+		return r
+	}
+	var msg string
+	if json.Unmarshal(body.Msg, &msg) == nil {
+		r.Err = errors.New(msg)
+		return r
+	}
+	r.Err = errors.New(string(body.Msg))
+	return r
+}
+
+// Exists asks for the model with the doc's manufacturer, category,
+// subcategory, year and model. Anything but a clear answer, such as a 5xx
+// or a body that isn't a models response, is lookupFailed so the doc is
+// reported instead of being posted or skipped by mistake.
+func (d *discordiaSink) Exists(docs Docs, s int) (recordLookup, string, error) {
+	q := neturl.Values{}
+	q.Set("manufacturer", docs[s].General.Manufacturer)
+	q.Set("category", docs[s].General.Category)
+	q.Set("subcategory", docs[s].General.Subcategory)
+	q.Set("year", strconv.Itoa(docs[s].General.Year))
+	q.Set("model", docs[s].General.Model)
+	return decodeLookup(doRequest("GET", d.cfg.ModelsUrl+"?"+q.Encode(), nil, map[string]string{"Authorization": d.token}))
+}
+
+// decodeLookup reads a {"data":[...]} models response. An existing model
+// always comes back with its _id.
+func decodeLookup(r SinkResult) (recordLookup, string, error) {
+	if r.Err != nil {
+		return lookupFailed, "", r.Err
+	}
+	if r.Code == http.StatusNotFound {
+		return recordMissing, "", nil
+	}
+	if r.Code < 200 || r.Code > 299 {
+		return lookupFailed, "", &statusError{code: r.Code, status: r.Status}
+	}
+	var found struct {
+		PatchId
+		Error interface{} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(r.Body), &found); err != nil {
+		return lookupFailed, "", errors.New("lookup response is not JSON: " + err.Error())
+	}
+	if found.Error != nil && found.Error != false && found.Error != "" {
+		return recordMissing, "", nil
+	}
+	if len(found.Data) == 0 {
+		return recordMissing, "", nil
+	}
+	// The _id is what the existing record is patched to, so a match without
+	// one can't be used.
+	if found.Data[0].Id == "" {
+		return lookupFailed, "", errors.New("lookup matched a model without an _id")
+	}
+	return recordExists, found.Data[0].Id, nil
+}
+
+func (d *discordiaSink) Create(docs Docs, s int) SinkResult {
+	mJ, _ := json.Marshal(docs[s])
+	r := discordiaError(doRequest("POST", d.cfg.Url, mJ, d.headers()))
+	fmt.Println("Response Status from Discordia:", r.Status)
+	r.Id = responseId(r.Body)
+	return r
+}
+
+func (d *discordiaSink) Update(id string, docs Docs, s int) SinkResult {
+	mJ, _ := json.Marshal(docs[s])
+	r := discordiaError(doRequest("PATCH", recordUrl(d.cfg.Url, id), mJ, d.headers()))
+	fmt.Println("Response Status from Discordia:", r.Status)
+	r.Id = id
+	return r
+}
+
+func (d *discordiaSink) Delete(id string) SinkResult {
+	return discordiaError(doRequest("DELETE", recordUrl(d.cfg.Url, id), nil, d.headers()))
+}
+
+func (d *discordiaSink) Deactivate(id string) SinkResult {
+	return discordiaError(doRequest("PATCH", recordUrl(d.cfg.Url, id), []byte(config.Retire.InactivePatch), d.headers()))
+}
+
+func (d *discordiaSink) Get(id string) (interface{}, error) {
+	return decodeRecord(doRequest("GET", recordUrl(d.cfg.Url, id), nil, d.headers()))
+}
+
+// Health lists a single model, which needs a working token and database.
+func (d *discordiaSink) Health() error {
+	r := doRequest("GET", d.cfg.ModelsUrl+"?limit=1", nil, map[string]string{"Authorization": d.token})
+	if r.Err != nil {
+		return r.Err
+	}
+	if r.Code != http.StatusOK {
+		return errors.New(d.name + " health check returned " + r.Status)
+	}
+	return nil
+}
+
+// List pages through ModelsUrl until a page comes back short, optionally
+// filtered to one meta.source.
+func (d *discordiaSink) List(source string) Docs {
+	var all Docs
+	for page := 1; ; page++ {
+		q := neturl.Values{}
+		q.Set("page", strconv.Itoa(page))
+		q.Set("limit", strconv.Itoa(config.Target.PageSize))
+		if source != "" {
+			q.Set("source", source)
+		}
+		r := doRequest("GET", d.cfg.ModelsUrl+"?"+q.Encode(), nil, map[string]string{"Authorization": d.token})
+		if r.Err != nil {
+			log.Fatal("Unable to list the target's models, the reported error was: " + r.Err.Error())
+		}
+		if r.Code != http.StatusOK {
+			log.Fatal("Unable to list the target's models, the response status was: " + r.Status)
+		}
+		var p ModelsPage
+		if err := json.Unmarshal([]byte(r.Body), &p); err != nil {
+			log.Fatal("Unable to decode the target's models, the reported error was: " + err.Error())
+		}
+		all = append(all, p.Data...)
+		fmt.Println("listed page", page, "of", d.name, "models,", len(all), "so far")
+		if len(p.Data) < config.Target.PageSize {
+			return all
+		}
+	}
+}
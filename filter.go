@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// trimFilter selects the PS_Trims rows a build, validate, diff or push
+// works on. Each field left empty matches everything; a row must match
+// every field that is set.
+type trimFilter struct {
+	manufacturers map[string]bool
+	prodTypes     map[string]bool
+	makeIds       map[string]bool
+	trimIds       map[string]bool
+	// years are inclusive [from, to] ranges.
+	years [][2]int
+}
+
+// selection is the filter given on the command line; nil selects every trim.
+var selection *trimFilter
+
+// trimFilterFlags are the filter switches shared by every command.
+type trimFilterFlags struct {
+	manufacturer *string
+	prodType     *string
+	year         *string
+	makeId       *string
+	trimId       *string
+}
+
+func addTrimFilterFlags(fs *flag.FlagSet) *trimFilterFlags {
+	return &trimFilterFlags{
+		manufacturer: fs.String("manufacturer", "", "only these ManufacturerName values, comma separated"),
+		prodType:     fs.String("prod-type", "", "only these ProdType values, comma separated"),
+		year:         fs.String("year", "", "only these model years, comma separated, e.g. 2019 or 2018-2020"),
+		makeId:       fs.String("make-id", "", "only these MakeId values, comma separated"),
+		trimId:       fs.String("trim-id", "", "only these TrimId values, comma separated"),
+	}
+}
+
+// filter returns the parsed flags, or nil when none were given.
+func (ff *trimFilterFlags) filter() *trimFilter {
+	f := &trimFilter{
+		manufacturers: filterSet(*ff.manufacturer, true),
+		prodTypes:     filterSet(*ff.prodType, true),
+		makeIds:       filterSet(*ff.makeId, false),
+		trimIds:       filterSet(*ff.trimId, false),
+	}
+	years, err := parseYears(*ff.year)
+	if err != nil {
+		log.Fatal("Invalid -year " + *ff.year + ": " + err.Error())
+	}
+	f.years = years
+	if f.manufacturers == nil && f.prodTypes == nil && f.makeIds == nil && f.trimIds == nil && f.years == nil {
+		return nil
+	}
+	return f
+}
+
+// filterSet splits a comma separated flag; names are matched case
+// insensitively, ids exactly.
+func filterSet(value string, fold bool) map[string]bool {
+	var set map[string]bool
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if fold {
+			v = strings.ToLower(v)
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[v] = true
+	}
+	return set
+}
+
+func parseYears(value string) ([][2]int, error) {
+	var years [][2]int
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		from, to := v, v
+		if i := strings.Index(v, "-"); i > 0 {
+			from, to = v[:i], v[i+1:]
+		}
+		lo, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, err
+		}
+		hi, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil {
+			return nil, err
+		}
+		if hi < lo {
+			return nil, errors.New(v + " ends before it starts")
+		}
+		years = append(years, [2]int{lo, hi})
+	}
+	return years, nil
+}
+
+func (f *trimFilter) match(t CrsTrims) bool {
+	if f.manufacturers != nil && !f.manufacturers[strings.ToLower(strings.TrimSpace(t.ManufacturerName))] {
+		return false
+	}
+	if f.prodTypes != nil && !f.prodTypes[strings.ToLower(strings.TrimSpace(t.ProdType))] {
+		return false
+	}
+	if f.makeIds != nil && !f.makeIds[t.MakeId] {
+		return false
+	}
+	if f.trimIds != nil && !f.trimIds[t.TrimId] {
+		return false
+	}
+	if f.years != nil {
+		year := int(math.Round(t.ModelYear))
+		in := false
+		for _, r := range f.years {
+			if year >= r[0] && year <= r[1] {
+				in = true
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	return true
+}
+
+// trims returns the selected rows; a nil filter returns ct unchanged.
+func (f *trimFilter) trims(ct []CrsTrims) []CrsTrims {
+	if f == nil {
+		return ct
+	}
+	var kept []CrsTrims
+	for _, t := range ct {
+		if f.match(t) {
+			kept = append(kept, t)
+		}
+	}
+	fmt.Println("filter selected", len(kept), "of", len(ct), "trims")
+	return kept
+}
+
+// docs returns the docs built from selected trims. Docs don't carry the
+// trim fields, so the selected PS_Trims rows are turned into record keys
+// the way buildDocs names models.
+func (f *trimFilter) docs(docs Docs) Docs {
+	if f == nil {
+		return docs
+	}
+	keys := make(map[string]bool)
+	for _, t := range f.trims(getCtFromTrimsFile()) {
+		keys[recordKey(t.ManufacturerName, int(math.Round(t.ModelYear)), t.ModelName+" "+t.TrimName)] = true
+	}
+	var kept Docs
+	for s := range docs {
+		if keys[docKey(docs, s)] {
+			kept = append(kept, docs[s])
+		}
+	}
+	fmt.Println("filter selected", len(kept), "of", len(docs), "docs")
+	return kept
+}
+
+// String describes the filter as the flags that select the same trims,
+// with each list sorted; a nil filter is "".
+func (f *trimFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, set := range []struct {
+		flag   string
+		values map[string]bool
+	}{
+		{"-manufacturer", f.manufacturers},
+		{"-prod-type", f.prodTypes},
+		{"-make-id", f.makeIds},
+		{"-trim-id", f.trimIds},
+	} {
+		if set.values == nil {
+			continue
+		}
+		var values []string
+		for v := range set.values {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		parts = append(parts, set.flag+" "+strings.Join(values, ","))
+	}
+	if f.years != nil {
+		var years []string
+		for _, r := range f.years {
+			years = append(years, strconv.Itoa(r[0])+"-"+strconv.Itoa(r[1]))
+		}
+		sort.Strings(years)
+		parts = append(parts, "-year "+strings.Join(years, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// matchDoc checks the fields a built or remote doc still carries. Only
+// -manufacturer and -year can be checked this way; the other flags need
+// the doc's trim in the feed.
+func (f *trimFilter) matchDoc(docs Docs, s int) bool {
+	year := docs[s].General.Year
+	return f.match(CrsTrims{ManufacturerName: docs[s].General.Manufacturer, ModelYear: float64(year)})
+}
+
+// selectionPath is where a build records the filter it was made with.
+func selectionPath(docsPath string) string {
+	return docsPath + ".selection"
+}
+
+// writeSelection records the current selection next to the docs file, or
+// removes the record after a full build.
+func writeSelection(docsPath string) {
+	if selection == nil {
+		if err := os.Remove(selectionPath(docsPath)); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		return
+	}
+	if err := ioutil.WriteFile(selectionPath(docsPath), []byte(selection.String()+"\n"), 0644); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// builtSelection is the filter the docs file was built with, "" for a full
+// build.
+func builtSelection(docsPath string) string {
+	raw, err := ioutil.ReadFile(selectionPath(docsPath))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.TrimSpace(string(raw))
+}
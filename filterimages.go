@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var yearPattern = regexp.MustCompile(`(?:^|[^0-9])((?:19|20)[0-9]{2})(?:[^0-9]|$)`)
+
+// imageFilter decides which files of the raw image drop are kept. A file is
+// kept when the feed references it, when its path carries a model year in
+// range, when its path names one of the manufacturers, or when it is a
+// color swatch.
+type imageFilter struct {
+	referenced    map[string]bool
+	minYear       int
+	maxYear       int
+	manufacturers []string
+}
+
+// feedImageNames returns the lower-cased file names referenced by the
+// trims, sample data and photogallery tables.
+func feedImageNames() map[string]bool {
+	names := make(map[string]bool)
+	add := func(name string) {
+		if name = strings.TrimSpace(name); name != "" {
+			names[strings.ToLower(filepath.Base(name))] = true
+		}
+	}
+	for _, t := range getCtFromTrimsFile() {
+		add(t.TrimPhoto)
+	}
+	for _, sd := range getCsdFromSampleDataFile() {
+		if sd.AttributeName == "Photo Name" || sd.AttributeName == "Photo Name (Floorplan)" {
+			add(sd.Value)
+		}
+	}
+	for _, pg := range getCpgFromPhotoGalleryFile() {
+		add(pg.PhotoName)
+	}
+	return names
+}
+
+func normalizeName(s string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "").Replace(s))
+}
+
+func (f imageFilter) keep(path string) (bool, string) {
+	if strings.Contains(path, "ColorSwatches") {
+		return true, "color swatch"
+	}
+	if f.referenced[strings.ToLower(filepath.Base(path))] {
+		return true, "referenced by feed"
+	}
+	if f.minYear != 0 || f.maxYear != 0 {
+		for _, m := range yearPattern.FindAllStringSubmatch(path, -1) {
+			year, _ := strconv.Atoi(m[1])
+			if (f.minYear == 0 || year >= f.minYear) && (f.maxYear == 0 || year <= f.maxYear) {
+				return true, "year " + m[1]
+			}
+		}
+	}
+	normalized := normalizeName(path)
+	for _, manuf := range f.manufacturers {
+		if m := normalizeName(manuf); m != "" && strings.Contains(normalized, m) {
+			return true, "manufacturer " + manuf
+		}
+	}
+	return false, "no rule matched"
+}
+
+// copyImage copies src to dest unless dest already has the same size and
+// is not older than src.
+func copyImage(src string, dest string, info os.FileInfo) error {
+	if existing, err := os.Stat(dest); err == nil && existing.Size() == info.Size() && !existing.ModTime().Before(info.ModTime()) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// filterImagesCommand replaces getOnly2018Images: instead of copying the
+// whole drop and deleting what isn't 2018, it copies only the files the
+// filter keeps and writes a manifest of every decision.
+func filterImagesCommand(args []string) {
+	fs := flag.NewFlagSet("filter-images", flag.ExitOnError)
+	src := fs.String("src", "all_images", "raw image drop")
+	dest := fs.String("dest", "images_after_delete", "where kept images are copied")
+	referenced := fs.Bool("referenced", true, "keep images referenced by the current feed")
+	minYear := fs.Int("min-year", config.ImageFilter.MinYear, "keep images whose path has a model year from this year on")
+	maxYear := fs.Int("max-year", config.ImageFilter.MaxYear, "keep images whose path has a model year up to this year")
+	manufacturers := fs.String("manufacturers", strings.Join(config.ImageFilter.Manufacturers, ","), "comma separated manufacturers to keep")
+	dryRun := fs.Bool("dry-run", false, "only write the manifest")
+	manifest := fs.String("manifest", "imageFilter.csv", "manifest of kept and removed files")
+	fs.Parse(args)
+
+	// Stale files are deleted from dest, and kept ones copied into it, so
+	// neither tree may hold the other.
+	if absSrc, absDest := absPath(*src), absPath(*dest); pathWithin(absSrc, absDest) || pathWithin(absDest, absSrc) {
+		fmt.Println("-src and -dest must not contain each other")
+		os.Exit(2)
+	}
+
+	filter := imageFilter{minYear: *minYear, maxYear: *maxYear}
+	if *referenced {
+		filter.referenced = feedImageNames()
+	}
+	for _, m := range strings.Split(*manufacturers, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			filter.manufacturers = append(filter.manufacturers, m)
+		}
+	}
+
+	var files []string
+	if err := filepath.Walk(*src, visit(&files)); err != nil {
+		panic(err)
+	}
+
+	deleteFile(*manifest)
+	createFile(*manifest)
+	f, err := os.OpenFile(*manifest, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"Action", "Path", "Reason"})
+
+	link := make(map[string]int)
+	kept := make(map[string]bool)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		rel, _ := filepath.Rel(*src, file)
+		keep, reason := filter.keep(rel)
+		action := "removed"
+		if keep {
+			action = "kept"
+			kept[rel] = true
+			if !*dryRun {
+				if err := copyImage(file, filepath.Join(*dest, rel), info); err != nil {
+					fmt.Println(err)
+					action = "error"
+					reason = err.Error()
+				}
+			}
+		}
+		link = countStatus(action, link)
+		writer.Write([]string{action, filepath.ToSlash(rel), reason})
+	}
+
+	// Files an earlier run copied that this one doesn't keep are deleted, so
+	// dest holds exactly the kept files.
+	var existing []string
+	if _, err := os.Stat(*dest); err == nil {
+		if err := filepath.Walk(*dest, visit(&existing)); err != nil {
+			panic(err)
+		}
+	}
+	for _, file := range existing {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		rel, _ := filepath.Rel(*dest, file)
+		if kept[rel] {
+			continue
+		}
+		action, reason := "deleted", "in dest but no longer kept"
+		if *dryRun {
+			action = "would delete"
+		} else if err := os.Remove(file); err != nil {
+			fmt.Println(err)
+			action, reason = "error", err.Error()
+		}
+		link = countStatus(action, link)
+		writer.Write([]string{action, filepath.ToSlash(rel), reason})
+	}
+	writer.Flush()
+	for key, value := range link {
+		fmt.Println(key, value)
+	}
+}
+
+func absPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return abs
+}
+
+// pathWithin reports whether p is dir or inside it.
+func pathWithin(p string, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
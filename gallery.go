@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// trimImages collects the image file names of one trim as buildJson walks
+// the feed, so they can be ordered, deduplicated and described together.
+type trimImages struct {
+	trimPhoto  string
+	heroes     []string
+	floorplans []string
+	gallery    []CrsPhotoGallery
+}
+
+// build returns the doc images: TrimPhoto first when present, then the
+// "Photo Name" and "Photo Name (Floorplan)" images, then the photogallery
+// ordered by PhotoMapId. A file name already used by an earlier source is
+// skipped. title is the alt text prefix, e.g. "2019 Polaris Sportsman 570".
+func (ti trimImages) build(title string) []Image {
+	var images []Image
+	seen := make(map[string]bool)
+	add := func(imageType string, name string, desc string, longdesc string) {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if key == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		img := newImage(imageType, name)
+		img.Desc = desc
+		img.Longdesc = longdesc
+		images = append(images, img)
+	}
+
+	add(imageHero, ti.trimPhoto, title, "")
+	for _, name := range ti.heroes {
+		add(imageHero, name, title, "")
+	}
+	for _, name := range ti.floorplans {
+		add(imageFloorplan, name, title+" floorplan", "")
+	}
+	gallery := append([]CrsPhotoGallery(nil), ti.gallery...)
+	sort.SliceStable(gallery, func(i, j int) bool { return gallery[i].PhotoMapId < gallery[j].PhotoMapId })
+	for _, pg := range gallery {
+		tags := splitTags(pg.Tags)
+		desc := title
+		if len(tags) > 0 {
+			desc = title + " - " + tags[0]
+		}
+		add(imageGallery, pg.PhotoName, desc, strings.Join(tags, ", "))
+	}
+	return images
+}
+
+// splitTags splits a photogallery tags cell on commas, pipes or semicolons.
+func splitTags(tags string) []string {
+	var out []string
+	for _, tag := range strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ',' || r == '|' || r == ';'
+	}) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+)
+
+// igneousSink pushes docs to the Igneous /specs API as flat JSON specs.
+type igneousSink struct {
+	name  string
+	cfg   TargetConfig
+	token string
+}
+
+func (g *igneousSink) Name() string { return g.name }
+
+func (g *igneousSink) headers() map[string]string {
+	return map[string]string{"Content-Type": "application/json", "Authorization": g.token}
+}
+
+// IgneousSpec is the body of a /specs record. The general fields sit at
+// the top level and every spec section is flattened into Specs.
+type IgneousSpec struct {
+	Source       string           `json:"source"`
+	Manufacturer string           `json:"manufacturer"`
+	Model        string           `json:"model"`
+	Year         int              `json:"year"`
+	Msrp         float64          `json:"msrp"`
+	Category     string           `json:"category"`
+	Subcategory  string           `json:"subcategory"`
+	Description  string           `json:"description"`
+	Countries    []string         `json:"countries"`
+	Images       []Image          `json:"images,omitempty"`
+	Videos       []Video          `json:"videos,omitempty"`
+	Features     []string         `json:"features,omitempty"`
+	Options      []string         `json:"options,omitempty"`
+	Colors       []Color          `json:"colors,omitempty"`
+	Attachments  []Attachment     `json:"attachments,omitempty"`
+	Specs        []IgneousSpecRow `json:"specs"`
+}
+
+type IgneousSpecRow struct {
+	Group string `json:"group"`
+	Key   string `json:"key"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// payload builds the /specs body for docs[s]. Rows are ordered by group,
+// then key, so equal docs send equal bodies.
+func (g *igneousSink) payload(docs Docs, s int) interface{} {
+	doc := docs[s]
+	spec := IgneousSpec{
+		Source:       doc.Meta.Source,
+		Manufacturer: doc.General.Manufacturer,
+		Model:        doc.General.Model,
+		Year:         doc.General.Year,
+		Msrp:         doc.General.Msrp,
+		Category:     doc.General.Category,
+		Subcategory:  doc.General.Subcategory,
+		Description:  doc.General.Description,
+		Countries:    doc.General.Countries,
+		Images:       doc.Images,
+		Videos:       doc.Videos,
+		Features:     doc.Features,
+		Options:      doc.Options,
+		Colors:       doc.Colors,
+		Attachments:  doc.Attachments,
+		Specs:        []IgneousSpecRow{},
+	}
+	groups := []struct {
+		name  string
+		specs map[string]Specs
+	}{
+		{"battery", doc.Battery},
+		{"body", doc.Body},
+		{"dimensions", doc.Dimensions},
+		{"drivetrain", doc.Drivetrain},
+		{"electrical", doc.Electrical},
+		{"engine", doc.Engine},
+		{"engineAndDriveTrain", doc.EngineAndDriveTrain},
+		{"engineDrivetrain", doc.EngineDrivetrain},
+		{"hydraulics", doc.Hydraulics},
+		{"measurements", doc.Measurements},
+		{"operational", doc.Operational},
+		{"other", doc.Other},
+		{"weights", doc.Weights},
+	}
+	for _, group := range groups {
+		keys := make([]string, 0, len(group.specs))
+		for k := range group.specs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			spec.Specs = append(spec.Specs, IgneousSpecRow{Group: group.name, Key: k, Label: group.specs[k].Label, Value: group.specs[k].Desc})
+		}
+	}
+	return spec
+}
+
+// igneousError reads {"message": ".."} or {"errors": [..]} error bodies.
+func igneousError(r SinkResult) SinkResult {
+	if r.Err != nil || (r.Code >= 200 && r.Code <= 299) {
+		return r
+	}
+	var body struct {
+		Message string        `json:"message"`
+		Errors  []interface{} `json:"errors"`
+	}
+	json.Unmarshal([]byte(r.Body), &body)
+	switch {
+	case body.Message != "":
+		r.Err = errors.New(body.Message)
+	case len(body.Errors) > 0:
+		out, _ := json.Marshal(body.Errors)
+		r.Err = errors.New(string(out))
+	default:
+		r.Err = errors.New(r.Status + ": " + r.Body)
+	}
+	return r
+}
+
+// Exists searches /specs by manufacturer, year and model.
+func (g *igneousSink) Exists(docs Docs, s int) (recordLookup, string, error) {
+	q := neturl.Values{}
+	q.Set("manufacturer", docs[s].General.Manufacturer)
+	q.Set("year", strconv.Itoa(docs[s].General.Year))
+	q.Set("model", docs[s].General.Model)
+	return decodeLookup(doRequest("GET", g.cfg.ModelsUrl+"?"+q.Encode(), nil, map[string]string{"Authorization": g.token}))
+}
+
+func (g *igneousSink) Create(docs Docs, s int) SinkResult {
+	mJ, _ := json.Marshal(g.payload(docs, s))
+	r := igneousError(doRequest("POST", g.cfg.Url, mJ, g.headers()))
+	fmt.Println("Response Status from Igneous:", r.Status)
+	r.Id = responseId(r.Body)
+	return r
+}
+
+func (g *igneousSink) Update(id string, docs Docs, s int) SinkResult {
+	mJ, _ := json.Marshal(g.payload(docs, s))
+	r := igneousError(doRequest("PATCH", recordUrl(g.cfg.Url, id), mJ, g.headers()))
+	fmt.Println("Response Status from Igneous:", r.Status)
+	r.Id = id
+	return r
+}
+
+func (g *igneousSink) Delete(id string) SinkResult {
+	return igneousError(doRequest("DELETE", recordUrl(g.cfg.Url, id), nil, g.headers()))
+}
+
+func (g *igneousSink) Get(id string) (interface{}, error) {
+	return decodeRecord(doRequest("GET", recordUrl(g.cfg.Url, id), nil, map[string]string{"Authorization": g.token}))
+}
+
+// Health treats any answer below 500 from the specs endpoint as up.
+func (g *igneousSink) Health() error {
+	r := doRequest("GET", g.cfg.Url, nil, map[string]string{"Authorization": g.token})
+	if r.Err != nil {
+		return r.Err
+	}
+	if r.Code >= http.StatusInternalServerError {
+		return errors.New(g.name + " health check returned " + r.Status)
+	}
+	return nil
+}
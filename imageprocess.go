@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+)
+
+// ImageVariant is one generated size. Width and Height bound the output;
+// the aspect ratio is kept, images are never enlarged, and 0 leaves that
+// side unbounded.
+type ImageVariant struct {
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	Quality int `json:"quality"`
+}
+
+// ImageManifest is written by "images process" and read by newImage so doc
+// links point at the generated files.
+type ImageManifest struct {
+	Images map[string]*ManifestEntry `json:"images"`
+}
+
+// ManifestEntry describes one source image, keyed in the manifest by its
+// path relative to the source tree. Source is the path the file had before
+// sort-images moved and renamed it, which is the name CRS refers to it by.
+// Variants maps a variant name to the generated file, relative to the
+// output tree, and VariantConfig is the hash of the variant settings they
+// were made with. A file whose content was already processed under another
+// name has DuplicateOf set and shares its variants.
+type ManifestEntry struct {
+	Hash          string            `json:"hash"`
+	Source        string            `json:"source,omitempty"`
+	DuplicateOf   string            `json:"duplicateOf,omitempty"`
+	Variants      map[string]string `json:"variants"`
+	VariantConfig string            `json:"variantConfig,omitempty"`
+}
+
+// ImageSortRow is one line of the sort-images manifest.
+type ImageSortRow struct {
+	Status      string `csv:"Status"`
+	Source      string `csv:"Source"`
+	Destination string `csv:"Destination"`
+	Detail      string `csv:"Detail"`
+}
+
+// readSortSources maps each sorted path to the source path it was copied
+// from. A missing manifest maps nothing.
+func readSortSources(path string) map[string]string {
+	sources := make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return sources
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	rows := []ImageSortRow{}
+	if err := gocsv.UnmarshalFile(f, &rows); err != nil {
+		log.Fatal("Unable to parse " + path + ", the reported error was: " + err.Error())
+	}
+	for _, r := range rows {
+		if r.Destination != "" && r.Status != "skipped" && r.Status != "error" {
+			sources[r.Destination] = r.Source
+		}
+	}
+	return sources
+}
+
+// variantConfigHash identifies the variant settings, so a change to them
+// regenerates every image.
+func variantConfigHash() string {
+	out, _ := json.Marshal(config.ImageProcessing.Variants)
+	sum := sha256.Sum256(out)
+	return hex.EncodeToString(sum[:])
+}
+
+func readImageManifest(path string) *ImageManifest {
+	m := &ImageManifest{Images: make(map[string]*ManifestEntry)}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		return m
+	}
+	if err := json.Unmarshal(raw, m); err != nil {
+		fmt.Println("Unable to parse " + path + ", the reported error was: " + err.Error())
+	}
+	if m.Images == nil {
+		m.Images = make(map[string]*ManifestEntry)
+	}
+	return m
+}
+
+func writeImageManifest(path string, m *ImageManifest) {
+	out, _ := json.MarshalIndent(m, "", "  ")
+	if err := ioutil.WriteFile(path, out, 0644); err != nil {
+		fmt.Println(err)
+	}
+}
+
+var manifestByName map[string]*ManifestEntry
+
+// manifestVariants returns the generated variants for an image file name,
+// or nil when config.Images.Manifest is unset or has no such file. Files
+// are matched on the name they had before sorting. The drop often holds
+// the same photo in several size or type folders, so when different
+// images share a name the first path in sort order is kept and the others
+// are listed.
+func manifestVariants(name string) map[string]string {
+	if config.Images.Manifest == "" {
+		return nil
+	}
+	if manifestByName == nil {
+		images := readImageManifest(config.Images.Manifest).Images
+		rels := make([]string, 0, len(images))
+		for rel := range images {
+			rels = append(rels, rel)
+		}
+		sort.Strings(rels)
+		manifestByName = make(map[string]*ManifestEntry)
+		owner := make(map[string]string)
+		for _, rel := range rels {
+			e := images[rel]
+			source := e.Source
+			if source == "" {
+				source = rel
+			}
+			key := strings.ToLower(path.Base(source))
+			if other, ok := manifestByName[key]; ok {
+				if other.Hash != e.Hash {
+					fmt.Println("images", owner[key], "and", rel, "are both named", path.Base(source)+"; using", owner[key])
+				}
+				continue
+			}
+			manifestByName[key] = e
+			owner[key] = rel
+		}
+	}
+	if e, ok := manifestByName[strings.ToLower(path.Base(name))]; ok {
+		return e.Variants
+	}
+	return nil
+}
+
+// fitSize scales w x h down to fit inside maxW x maxH.
+func fitSize(w int, h int, maxW int, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	nw, nh := int(float64(w)*scale+0.5), int(float64(h)*scale+0.5)
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+	return nw, nh
+}
+
+// resizeImage downsamples with a box filter: every output pixel is the
+// average of the source pixels it covers.
+func resizeImage(src image.Image, w int, h int) *image.RGBA {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	if w == b.Dx() && h == b.Dy() {
+		return rgba
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*b.Dy()/h, (y+1)*b.Dy()/h
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*b.Dx()/w, (x+1)*b.Dx()/w
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(rgba.Pix[i])
+					g += int(rgba.Pix[i+1])
+					bl += int(rgba.Pix[i+2])
+					a += int(rgba.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			o := dst.PixOffset(x, y)
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(bl / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// writeVariant re-encodes img, which drops EXIF and any other metadata of
+// the source file.
+func writeVariant(img image.Image, format string, v ImageVariant, dest string) error {
+	w, h := fitSize(img.Bounds().Dx(), img.Bounds().Dy(), v.Width, v.Height)
+	resized := resizeImage(img, w, h)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, resized)
+	} else {
+		quality := v.Quality
+		if quality == 0 {
+			quality = 85
+		}
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dest, buf.Bytes(), 0644)
+}
+
+func variantsExist(outDir string, e *ManifestEntry) bool {
+	for _, p := range e.Variants {
+		if _, err := os.Stat(filepath.Join(outDir, filepath.FromSlash(p))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func imagesCommand(args []string) {
+	if len(args) == 0 || args[0] != "process" {
+		fmt.Println("usage: images process [flags]")
+		os.Exit(2)
+	}
+	processImagesCommand(args[1:])
+}
+
+// processImagesCommand generates every configured size variant of the
+// sorted image tree. Files whose content hash matches the previous
+// manifest are skipped, and identical files are processed once.
+func processImagesCommand(args []string) {
+	fs := flag.NewFlagSet("images process", flag.ExitOnError)
+	src := fs.String("src", "sorted_images", "images to process")
+	outDir := fs.String("out", config.ImageProcessing.Output, "where variants are written, one folder per variant")
+	manifestPath := fs.String("manifest", "imageManifest.json", "manifest of generated variants")
+	sortManifest := fs.String("sort-manifest", "imageSort.csv", "sort-images manifest, for the names files had before sorting")
+	fs.Parse(args)
+
+	sources := readSortSources(*sortManifest)
+	variantConfig := variantConfigHash()
+	previous := readImageManifest(*manifestPath)
+	manifest := &ImageManifest{Images: make(map[string]*ManifestEntry)}
+	byHash := make(map[string]string)
+
+	var files []string
+	if err := filepath.Walk(*src, visit(&files)); err != nil {
+		panic(err)
+	}
+	sort.Strings(files)
+
+	variantNames := make([]string, 0, len(config.ImageProcessing.Variants))
+	for name := range config.ImageProcessing.Variants {
+		variantNames = append(variantNames, name)
+	}
+	sort.Strings(variantNames)
+
+	link := make(map[string]int)
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file))
+		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+			continue
+		}
+		rel, _ := filepath.Rel(*src, file)
+		rel = filepath.ToSlash(rel)
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Println(err)
+			link = countStatus("error", link)
+			continue
+		}
+		sum := sha256.Sum256(raw)
+		hash := hex.EncodeToString(sum[:])
+		source := sources[rel]
+
+		if canonical, ok := byHash[hash]; ok {
+			canon := manifest.Images[canonical]
+			manifest.Images[rel] = &ManifestEntry{Hash: hash, Source: source, DuplicateOf: canonical, Variants: canon.Variants, VariantConfig: canon.VariantConfig}
+			link = countStatus("duplicate", link)
+			continue
+		}
+		if old, ok := previous.Images[rel]; ok && old.Hash == hash && old.DuplicateOf == "" &&
+			old.VariantConfig == variantConfig && variantsExist(*outDir, old) {
+			old.Source = source
+			manifest.Images[rel] = old
+			byHash[hash] = rel
+			link = countStatus("unchanged", link)
+			continue
+		}
+
+		img, format, err := image.Decode(bytes.NewReader(raw))
+		if err != nil {
+			fmt.Println(rel, err)
+			link = countStatus("error", link)
+			continue
+		}
+		entry := &ManifestEntry{Hash: hash, Source: source, Variants: make(map[string]string), VariantConfig: variantConfig}
+		failed := false
+		for _, name := range variantNames {
+			out := path.Join(name, rel)
+			if err := writeVariant(img, format, config.ImageProcessing.Variants[name], filepath.Join(*outDir, filepath.FromSlash(out))); err != nil {
+				fmt.Println(rel, err)
+				failed = true
+				break
+			}
+			entry.Variants[name] = out
+		}
+		if failed {
+			link = countStatus("error", link)
+			continue
+		}
+		manifest.Images[rel] = entry
+		byHash[hash] = rel
+		link = countStatus("processed", link)
+	}
+	writeImageManifest(*manifestPath, manifest)
+	for key, value := range link {
+		fmt.Println(key, value)
+	}
+}
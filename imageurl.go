@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Image types, used as the Images[].type of a doc and as the keys of
+// config.Images.Folders.
+const (
+	imageHero      = "hero"
+	imageFloorplan = "floorplan"
+	imageGallery   = "gallery"
+)
+
+// newImage builds the CDN entry for a CRS image file. Src is the
+// config.Images.DefaultVariant size; every configured size of the type is
+// listed in Variants. Files in the processed image manifest link to their
+// generated variants instead.
+func newImage(imageType string, name string) Image {
+	img := Image{Type: imageType}
+	paths := make(map[string]string)
+	if processed := manifestVariants(name); processed != nil {
+		for v, p := range processed {
+			paths[v] = imageUrl(p, "")
+		}
+	} else {
+		for v, folder := range config.Images.Folders[imageType] {
+			paths[v] = imageUrl(folder, name)
+		}
+	}
+	variants := make([]string, 0, len(paths))
+	for v := range paths {
+		variants = append(variants, v)
+	}
+	sort.Strings(variants)
+	for _, v := range variants {
+		if img.Variants == nil {
+			img.Variants = make(map[string]string)
+		}
+		img.Variants[v] = paths[v]
+	}
+	img.Src = img.Variants[config.Images.DefaultVariant]
+	if img.Src == "" && len(variants) > 0 {
+		img.Src = img.Variants[variants[0]]
+	}
+	if img.Src == "" {
+		fmt.Println("no image folder configured for type", imageType)
+	}
+	return img
+}
+
+// imageUrl joins the CDN base, folder and file name, escaping each path
+// segment of folder and name.
+func imageUrl(folder string, name string) string {
+	base := config.Images.BaseUrl
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	var segments []string
+	for _, part := range []string{folder, name} {
+		for _, seg := range strings.Split(part, "/") {
+			if seg != "" {
+				segments = append(segments, escapePathSegment(seg))
+			}
+		}
+	}
+	return base + strings.Join(segments, "/")
+}
+
+// escapePathSegment percent-encodes everything except the RFC 3986
+// unreserved characters. url.PathEscape leaves "&", "+" and friends alone,
+// which S3 does not treat as literals.
+func escapePathSegment(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&15])
+	}
+	return b.String()
+}
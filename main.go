@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
@@ -12,10 +11,12 @@ import (
 	"strings"
 	"strconv"
 	"errors"
+	"flag"
+	"sort"
+	"sync"
   "log"
   "path/filepath"
 	"github.com/gocarina/gocsv"
- 	"github.com/otiai10/copy"
 )
 
 type Docs []struct {
@@ -23,6 +24,8 @@ type Docs []struct {
 	ProductUri string `json:"productUri"`
 	Meta       struct {
 		Source string `json:"source"`
+		// Active is only set on records retire marked inactive.
+		Active *bool `json:"active,omitempty"`
 		// Test string `json:"test"`
 	} `json:"meta"`
 	General    struct {
@@ -34,24 +37,14 @@ type Docs []struct {
 		Subcategory  string   `json:"subcategory"`
 		Description  string   `json:"description"`
 		Countries    []string `json:"countries"`
+		ManufacturerCountry string `json:"manufacturerCountry,omitempty"`
 	} `json:"general"`
-	Images []struct {
-		Src      string `json:"src"`
-		Desc     string `json:"desc"`
-		Longdesc string `json:"longdesc"`
-	} `json:"images,omitempty"`
-	Videos []struct {
-		Src      string `json:"src"`
-		Desc     string `json:"desc"`
-		Longdesc string `json:"longdesc"`
-	} `json:"videos,omitempty"`
+	Images []Image `json:"images,omitempty"`
+	Videos []Video `json:"videos,omitempty"`
 	Features    []string `json:"features,omitempty"`
 	Options     []string `json:"options,omitempty"`
-	Attachments []struct {
-		AttachmentDescription     string `json:"attachmentDescription"`
-		AttachmentLocation        string `json:"attachmentLocation"`
-		AttachmentLongDescription string `json:"attachmentLongDescription"`
-	} `json:"attachments,omitempty"`
+	Colors      []Color  `json:"colors,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
 	Operational         map[string]Specs `json:"operational,omitempty"`
 	Other               map[string]Specs `json:"other,omitempty"`
 	EngineDrivetrain    map[string]Specs `json:"engineDrivetrain,omitempty"`
@@ -76,6 +69,8 @@ type Image struct {
 	Src      string `json:"src"`
 	Desc     string `json:"desc"`
 	Longdesc string `json:"longdesc"`
+	Type     string `json:"type,omitempty"`
+	Variants map[string]string `json:"variants,omitempty"`
 }
 
 type PatchId struct {
@@ -221,8 +216,8 @@ func deleteFile(path string) {
 	os.Remove(path)
 }
 
-var url string
-
+// getAPI asks which target to push to and returns its name in
+// config.Targets, e.g. discordia-prod.
 func getAPI() string{
 	fmt.Print("Enter api discordia or igneous: ")
 	var api string
@@ -232,38 +227,24 @@ func getAPI() string{
 	var apiType string
 	fmt.Scanln(&apiType)
 
-	if (api == "igneous"){
-		if apiType == "stage"{
-			url = "https://api.stage.cwsplatform.com/specs"
-		}else if apiType == "prod"{
-			url = "https://api.prod.cwsplatform.com/specs"
-		}
-	}else if api == "discordia"{
-			if apiType == "stage"{
-				url = "http://127.0.0.1:5000/v1/model/"
-			}else if apiType == "prod"{
-				url = "https://discordia.blackbook.tilabs.tech/v1/model/"
-			}
-		}else{
-			err :=errors.New("Please enter valid input")
-			if err != nil {
-				log.Fatal(err)
-			}
+	name := api + "-" + apiType
+	if _, ok := config.Targets[name]; !ok || (apiType != "stage" && apiType != "prod") {
+		err :=errors.New("Please enter valid input")
+		if err != nil {
+			log.Fatal(err)
 		}
-		return url
 	}
+	return name
+}
 
+	// ObtainNebulousToken gets a client credentials token from
+	// config.Nebulous. NEB_TOKEN_ENDPOINT, NEB_CLIENT_ID and
+	// NEB_CLIENT_SECRET override the config when set.
 	func ObtainNebulousToken() string {
-		// url := os.Getenv("NEB_TOKEN_ENDPOINT")
-		//
-		// clientID := os.Getenv("NEB_CLIENT_ID")
-		// clientSecret := os.Getenv("NEB_CLIENT_SECRET")
-
-		url := "https://apis.traderonline.com/vLatest/token"
+		url := envOr("NEB_TOKEN_ENDPOINT", config.Nebulous.TokenUrl)
 		fmt.Println("token endpoint url is",url)
-		clientID := "blackbook"
-		clientSecret := "#ZoDDn08ZlQjncScAfs1?3URoX8JPDZN"
-	 fmt.Println("clientsecret is",clientSecret)
+		clientID := envOr("NEB_CLIENT_ID", config.Nebulous.ClientId)
+		clientSecret := envOr("NEB_CLIENT_SECRET", config.Nebulous.ClientSecret)
 
 		nebulousToken := ""
 
@@ -276,10 +257,9 @@ func getAPI() string{
 		req.Header.Add("content-type", "multipart/form-data; boundary=----WebKitFormBoundary7MA4YWxkTrZu0gW")
 		req.Header.Add("Cache-Control", "no-cache")
 
-		res, err := http.DefaultClient.Do(req)
+		res, err := httpClient().Do(req)
 		if err != nil {
 			log.Println("An issue arose while attempting to capture the response from nebulous to obtain a token, the reported error was: " + err.Error())
-			res.Body.Close()
 			return nebulousToken
 		}
 
@@ -300,14 +280,142 @@ func getAPI() string{
 		}
 
 		nebulousToken = token.AccessToken
-		fmt.Println(nebulousToken)
 		fmt.Println("In obtain token function")
 		return nebulousToken
 	}
 
-func postJson() {
-	nebulousToken:=ObtainNebulousToken()
-	docs := getDocs("out.json")
+func envOr(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// pushOptions are the command line switches of a push.
+type pushOptions struct {
+	// verify re-fetches every created or updated record after the push
+	// and writes the differences to verification.csv.
+	verify bool
+	// snapshot, when set, is a "snapshot" file existence is resolved from
+	// instead of a lookup per doc.
+	snapshot string
+	// dryRun reports what would be created or updated without sending.
+	dryRun bool
+	// targets are the configured targets to push to. Each one gets its own
+	// workers, state and report section.
+	targets []string
+	// workers is how many docs are sent to one target at a time.
+	workers int
+	// runId is set by pushRun and recorded with every pushed doc.
+	runId string
+	// promotedFrom is the run a promotion pushes, empty for a build.
+	promotedFrom string
+	// canary, when above 0, is how many docs are pushed and read back
+	// before the rest.
+	canary int
+	// canaryOnFailure is abort or pause.
+	canaryOnFailure string
+	// resumeFrom skips the docs before this index, as reported by an
+	// aborted push.
+	resumeFrom int
+}
+
+// pushTargets returns the targets named in a comma separated -target value,
+// else config.Push.Targets, else the one picked at the prompt.
+func pushTargets(flagValue string) []string {
+	var names []string
+	for _, name := range strings.Split(flagValue, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = config.Push.Targets
+	}
+	if len(names) == 0 {
+		names = []string{getAPI()}
+	}
+	for _, name := range names {
+		if _, ok := config.Targets[name]; !ok {
+			log.Fatal("No target called " + name + " in config")
+		}
+	}
+	return names
+}
+
+// targetRun is what the push to one target produced.
+type targetRun struct {
+	sink   Sink
+	docs   Docs
+	link   map[string]int
+	pushed []pushedDoc
+	// accepted are the docs the target now holds as sent: created,
+	// updated or unchanged.
+	accepted []int
+	// canaryChecked and canaryFailed are the canary's sample size and
+	// how many of it failed to push or read back.
+	canaryChecked int
+	canaryFailed  int
+	guard         *pushGuard
+	// results has every doc that was tried, true when it went through.
+	results map[int]bool
+	// resumeFrom is the first doc a resumed push should start at after an
+	// abort, -1 otherwise.
+	resumeFrom int
+	// err is why the target was stopped, if it was.
+	err error
+}
+
+// failureLog is nonExistingManufacturers.csv, shared by every target's
+// workers. Each row starts with the target it came from.
+type failureLog struct {
+	mu     sync.Mutex
+	writer *csv.Writer
+}
+
+func (fl *failureLog) write(row ...string) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.writer.Write(row)
+	fl.writer.Flush()
+}
+
+func postJson(opts pushOptions) {
+	var snap *catalogSnapshot
+	if opts.snapshot != "" {
+		if len(opts.targets) != 1 {
+			log.Fatal("A snapshot is a copy of one target, use -snapshot with a single -target")
+		}
+		snap = loadSnapshot(opts.snapshot)
+	}
+	nebulousToken := ""
+	if !opts.dryRun || snap == nil {
+		nebulousToken = ObtainNebulousToken()
+	}
+	docs := validateDocs(selection.docs(getDocs("out.json")), loadTaxonomy(), config.Validation.Quarantine)
+	var batches []pushBatch
+	for _, name := range opts.targets {
+		batches = append(batches, pushBatch{target: name, docs: docs})
+	}
+	pushRun(opts, batches, snap, nebulousToken)
+}
+
+// pushBatch is the docs one target is sent.
+type pushBatch struct {
+	target string
+	docs   Docs
+}
+
+// pushRun sends every batch to its target under a new run id, writes the
+// reports and keeps the docs each target accepted for "promote".
+func pushRun(opts pushOptions, batches []pushBatch, snap *catalogSnapshot, nebulousToken string) {
+	for _, b := range batches {
+		if opts.resumeFrom < 0 || (opts.resumeFrom > 0 && opts.resumeFrom >= len(b.docs)) {
+			log.Fatal(fmt.Sprintf("-resume-from %d is outside the %d docs for %s; it must be from 0 to %d", opts.resumeFrom, len(b.docs), b.target, len(b.docs)-1))
+		}
+	}
+	opts.runId = newRunId()
+	fmt.Println("push run", opts.runId)
 	deleteFile("nonExistingManufacturers.csv")
 	fmt.Println("deleted nonExistingManufacturers.csv")
 
@@ -317,17 +425,19 @@ func postJson() {
 	deleteFile("Report.csv")
 	fmt.Println("deleted report.csv")
 
-  createFile("Report.csv")
+	createFile("Report.csv")
 	fmt.Println("created report.csv")
 
-	var link map[string]int
-	link = make(map[string]int)
+	if opts.canary > 0 {
+		deleteFile("canary.csv")
+	}
+
 	f, err := os.OpenFile("nonExistingManufacturers.csv", os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		panic(err)
 	}
 	defer f.Close()
-	writer := csv.NewWriter(f)
+	failures := &failureLog{writer: csv.NewWriter(f)}
 
 	f1, err := os.OpenFile("Report.csv", os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
@@ -335,158 +445,320 @@ func postJson() {
 	}
 	defer f1.Close()
 	writer1 := csv.NewWriter(f1)
+	writer1.Write([]string{"Run", opts.runId})
+
+	state := loadPushState(config.State.File)
+	defer state.save(config.State.File)
+
+	// Every target is pushed at the same time; a target that is down or
+	// failing only shows up in its own section.
+	runs := make([]*targetRun, len(batches))
+	var wg sync.WaitGroup
+	for t, b := range batches {
+		runs[t] = &targetRun{sink: newSink(b.target, nebulousToken), docs: b.docs, link: make(map[string]int), guard: newPushGuard(), results: make(map[int]bool), resumeFrom: -1}
+		wg.Add(1)
+		go func(run *targetRun) {
+			defer wg.Done()
+			pushTarget(run, state, snap, opts, failures)
+		}(runs[t])
+	}
+	wg.Wait()
+	if !opts.dryRun {
+		for _, run := range runs {
+			archiveRun(opts.runId, run)
+		}
+		writeRunInfo(opts)
+	}
 
-	for s := 0; s < len(docs); s++ {
-		fmt.Println(s)
-		statCode := ""
-		bodyString := ""
-		// idStr, _ := getSpecId(docs,s)
-		mJ, _ := json.Marshal(docs[s])
-
-		fmt.Println("Token for model in post json", nebulousToken)
-
-		// This check if the model is already existing in discordia.
-		checkStatus:=checkIfRecordExists(docs,s,nebulousToken)
-		fmt.Println("Token print loop in post json",s)
-
-		// If model does not exist then it posts it and repsonse is added in the report file. Otherwise skips.
-   if (checkStatus==false){
-		statCode,bodyString=postRecord(mJ,nebulousToken)
-		// fmt.Println(idStr)
-		// if idStr != "" {
-		// 		statCode, bodyString = patchRecord(idStr, mJ)
-		// } else {
-		// 	statCode, bodyString = postRecord(mJ)
-		// }
-		// if idStr == ""{
-		// 	statCode, bodyString = postRecord(mJ)
-		// }
-		// fmt.Println(statCode)
-		// fmt.Println(bodyString)
-		// if bodyString== strings.Replace("{'error':true,'msg':{'general.manufacturer':['Manufacturer was not found.']}}","'","\"",-1) {
-		// 	var csvData []string
-		// 	csvData = append(csvData, statCode)
-		// 	csvData = append(csvData, docs[s].General.Manufacturer)
-		// 	csvData = append(csvData, bodyString)
-		// 	writer.Write(csvData)
-		// 	writer.Flush()
-		// }
-		if statCode != "200 OK" && statCode != "201 Created" && statCode != "" {
-				if docs[s].Id == "" {
-					docs[s].Id = strconv.Itoa(s)
-				}
-				var csvData []string
-				csvData = append(csvData, statCode)
-				csvData = append(csvData, docs[s].General.Manufacturer)
-				csvData = append(csvData, bodyString)
-				writer.Write(csvData)
-				writer.Flush()
-			}
-		link = countStatus(statCode, link)
-	}else{
-		statCode="500 Duplicate"
-		bodyString=docs[s].General.Model+ " already exists in discordia. So skipped."
-		var csvData []string
-		csvData = append(csvData, docs[s].General.Manufacturer,docs[s].General.Model)
-		csvData = append(csvData, bodyString)
-		writer.Write(csvData)
-		writer.Flush()
-		link = countStatus(statCode, link)
+	if opts.verify {
+		deleteFile("verification.csv")
 	}
-}
-	var csvData1 []string
-	csvData1 = append(csvData1, "Report")
-	writer1.Write(csvData1)
-	writer1.Flush()
-	for key, value := range link {
-		var csvData []string
-		csvData = append(csvData, key)
-		csvData = append(csvData, strconv.Itoa(value))
-		writer1.Write(csvData)
+	for _, run := range runs {
+		writer1.Write([]string{"Report", run.sink.Name()})
+		if run.err != nil {
+			writer1.Write([]string{"Stopped", run.err.Error()})
+		}
+		if run.resumeFrom >= 0 {
+			writer1.Write([]string{"Resume from", strconv.Itoa(run.resumeFrom), run.docs[run.resumeFrom].General.Manufacturer, strconv.Itoa(run.docs[run.resumeFrom].General.Year), run.docs[run.resumeFrom].General.Model})
+		}
+		if opts.canary > 0 {
+			writer1.Write([]string{"Canary", strconv.Itoa(run.canaryChecked)})
+			writer1.Write([]string{"Canary failures", strconv.Itoa(run.canaryFailed)})
+		}
+		for key, value := range run.link {
+			var csvData []string
+			csvData = append(csvData, key)
+			csvData = append(csvData, strconv.Itoa(value))
+			writer1.Write(csvData)
+		}
+		if opts.verify {
+			checked, failed := verifyPushed(run.sink, run.docs, run.pushed, "verification.csv")
+			writer1.Write([]string{"Verified", strconv.Itoa(checked)})
+			writer1.Write([]string{"Verification mismatches", strconv.Itoa(failed)})
+		}
 		writer1.Flush()
 	}
 }
 
+// pushTarget sends every doc to one target with opts.workers workers. A
+// target that fails its health check is stopped before anything is sent,
+// and a doc that panics is reported without taking its target down. With
+// opts.canary a sample goes first and has to pass before the rest is sent.
+func pushTarget(run *targetRun, state *PushState, snap *catalogSnapshot, opts pushOptions, failures *failureLog) {
+	name := run.sink.Name()
+	if !opts.dryRun {
+		if err := run.sink.Health(); err != nil {
+			run.err = err
+			fmt.Println(name, "is not healthy, nothing was pushed to it:", err)
+			return
+		}
+	}
 
-func countStatus(statCode string, link map[string]int) map[string]int {
-	if len(link) == 0 {
-		link[statCode] = 1
-	} else {
-		if _, ok := link[statCode]; ok {
-			link[statCode] = link[statCode] + 1
-		} else {
-			link[statCode] = 1
+	var rest []int
+	for s := opts.resumeFrom; s < len(run.docs); s++ {
+		rest = append(rest, s)
+	}
+	if opts.canary > 0 {
+		sample := canarySample(run.docs, rest, opts.canary)
+		if err := runCanary(run, sample, state, snap, opts, failures); err != nil {
+			run.err = err
+			fmt.Println(name, "stopped after the canary:", err)
+			run.setResumePoint(opts.resumeFrom)
+			run.finish()
+			return
 		}
+		inSample := make(map[int]bool)
+		for _, s := range sample {
+			inSample[s] = true
+		}
+		kept := rest[:0]
+		for _, s := range rest {
+			if !inSample[s] {
+				kept = append(kept, s)
+			}
+		}
+		rest = kept
 	}
-	return link
+	if _, err := pushIndices(run, rest, state, snap, opts, failures); err != nil {
+		run.err = err
+		fmt.Println(name, err)
+		run.setResumePoint(opts.resumeFrom)
+	}
+	run.finish()
 }
 
-func checkIfRecordExists(docs Docs,s int,nebulousToken string) bool{
-	type GetError struct {
-		Error  string `json:"error"`
+// setResumePoint finds the first doc from start on that didn't go through,
+// because it failed or was never tried. The canary goes out of feed order
+// and workers finish out of order, so anything before it is done.
+func (run *targetRun) setResumePoint(start int) {
+	run.resumeFrom = -1
+	for s := start; s < len(run.docs); s++ {
+		if !run.results[s] {
+			run.resumeFrom = s
+			return
+		}
 	}
-	showModel:="https://discordia.blackbook.tilabs.tech/v1/models"
-	man:=docs[s].General.Manufacturer
-	cat:=docs[s].General.Category
-	subcat:=docs[s].General.Subcategory
-	year:=docs[s].General.Year
-	model:=docs[s].General.Model
-	showModelUrl:=showModel+"?manufacturer="+man+"&category="+cat+"&subcategory="+subcat+"&year="+strconv.Itoa(year)+"&model="+model
-	showModelUrl=strings.Replace(showModelUrl, " ", "%20", -1)
-
-	// try to get a record if exists
-	getReq, getErr := http.NewRequest("GET", showModelUrl,nil)
-	if getErr != nil {
-		panic(getErr)
+}
+
+// pushIndices sends the docs at indices in order and returns how many
+// failed. When run.guard calls for an abort, no further docs are started
+// and the returned error says why.
+func pushIndices(run *targetRun, indices []int, state *PushState, snap *catalogSnapshot, opts pushOptions, failures *failureLog) (int, error) {
+	workers := opts.workers
+	if workers < 1 {
+		workers = 1
 	}
-	getReq.Header.Add("Authorization", nebulousToken)
-	getResp, getErr := http.DefaultClient.Do(getReq)
-	if getErr != nil {
-		fmt.Println(getErr)
-		fmt.Println("error","could not get record")
+
+	failed := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				// A doc handed over just before an abort is left for the resume.
+				if run.guard.aborted() != "" {
+					continue
+				}
+				o := pushDocSafely(run.sink, run.docs, s, state, snap, opts, failures)
+				mu.Lock()
+				run.link = countStatus(o.status, run.link)
+				if o.pushed != nil {
+					run.pushed = append(run.pushed, *o.pushed)
+				}
+				if o.pushed != nil || o.status == "Unchanged" {
+					run.accepted = append(run.accepted, s)
+				}
+				if pushFailed(o) {
+					failed++
+				}
+				run.results[s] = !pushFailed(o)
+				mu.Unlock()
+				run.guard.observe(o)
+			}
+		}()
 	}
-	body, err := ioutil.ReadAll(getResp.Body)
-	if err != nil {
-		panic(getErr)
+	for i, s := range indices {
+		if run.guard.aborted() != "" {
+			break
+		}
+		if i%50 == 0 {
+			state.save(config.State.File)
+		}
+		jobs <- s
+	}
+	close(jobs)
+	wg.Wait()
+
+	reason := run.guard.aborted()
+	if reason == "" {
+		return failed, nil
 	}
+	return failed, errors.New("aborted: " + reason)
+}
 
-	var er GetError
-	json.Unmarshal(body,&er)
-	if(er.Error==""){
-		return true
-	}else{
+// pushFailed tells errors apart from docs that were sent, skipped as
+// unchanged or already there, or only counted in a dry run.
+func pushFailed(o pushOutcome) bool {
+	if o.pushed != nil {
+		return false
+	}
+	switch o.status {
+	case "Unchanged", "500 Duplicate", "Would create", "Would update":
 		return false
 	}
+	return true
+}
 
+func (run *targetRun) finish() {
+	sort.Slice(run.pushed, func(i, j int) bool { return run.pushed[i].index < run.pushed[j].index })
+	sort.Ints(run.accepted)
 }
 
-func postRecord(mJ []byte,nebulousToken string) (string, string) {
-	fmt.Println("Im in post record function")
-	statCode := ""
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(mJ))
-	if err != nil {
-		panic(err)
+// pushOutcome is what happened to one doc: the status it is counted
+// under, whether the target was asked anything, the HTTP code behind it
+// when there was one, and the pushed record when it was created or
+// updated.
+type pushOutcome struct {
+	status string
+	sent   bool
+	code   int
+	pushed *pushedDoc
+}
+
+func pushDocSafely(sink Sink, docs Docs, s int, state *PushState, snap *catalogSnapshot, opts pushOptions, failures *failureLog) (o pushOutcome) {
+	defer func() {
+		if r := recover(); r != nil {
+			o = pushOutcome{status: "Panic", sent: true}
+			failures.write(sink.Name(), o.status, docs[s].General.Manufacturer, fmt.Sprint(r))
+		}
+	}()
+	return pushDoc(sink, docs, s, state, snap, opts, failures)
+}
+
+// pushDoc sends one doc to a target.
+func pushDoc(sink Sink, docs Docs, s int, state *PushState, snap *catalogSnapshot, opts pushOptions, failures *failureLog) pushOutcome {
+	name := sink.Name()
+	fmt.Println(name, s)
+	key := docKey(docs, s)
+	hash := docHash(docs, s)
+
+	// Docs already pushed with the same content are skipped without asking the target,
+	// docs pushed with other content are patched in place.
+	if rec, ok := state.lookup(name, key); ok && rec.Hash == hash {
+		return pushOutcome{status: "Unchanged"}
+	} else if ok && rec.Id != "" {
+		return updateDoc(sink, docs, s, rec.Id, state, opts, failures)
 	}
-	fmt.Println(url)
-	fmt.Println(nebulousToken)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", nebulousToken)
-	// client := &http.Client{}
-	// resp, err := client.Do(req)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Println(err)
-		fmt.Println("In if err loop")
-		return "error","no patch"
+
+	// This check if the model is already existing in the target.
+	checkStatus, remoteId := recordMissing, ""
+	if snap != nil {
+		if id, remoteHash, ok := snap.lookup(key); ok {
+			// The snapshot holds the record itself, so one that already matches is
+			// only taken into the state.
+			if id != "" && remoteHash == hash {
+				if !opts.dryRun {
+					state.record(name, key, id, hash, opts.runId)
+				}
+				return pushOutcome{status: "Unchanged"}
+			}
+			checkStatus, remoteId = recordExists, id
+		}
+	} else {
+		var lookupErr error
+		checkStatus, remoteId, lookupErr = sink.Exists(docs, s)
+		if checkStatus == lookupFailed {
+			failures.write(name, "Lookup failed", docs[s].General.Manufacturer, docs[s].General.Model, lookupErr.Error())
+			o := pushOutcome{status: "Lookup failed", sent: true}
+			if se, ok := lookupErr.(*statusError); ok {
+				o.code = se.code
+			}
+			return o
+		}
 	}
-	fmt.Println("Response Status from Discordia:", resp.Status)
-	bodyBytes, _ := ioutil.ReadAll(resp.Body)
-	bodyString := string(bodyBytes)
-	statCode = resp.Status
-	fmt.Println(statCode)
-	return statCode, bodyString
+
+	// A model the target already has but the state doesn't know, for example after the
+	// state file was deleted, is patched to what was built and taken into the state.
+	// If model does not exist then it posts it and repsonse is added in the report file.
+	if checkStatus == recordExists {
+		if remoteId == "" {
+			failures.write(name, docs[s].General.Manufacturer, docs[s].General.Model, docs[s].General.Model+" already exists in "+name+" without an _id. So skipped.")
+			return pushOutcome{status: "500 Duplicate", sent: snap == nil}
+		}
+		return updateDoc(sink, docs, s, remoteId, state, opts, failures)
+	}
+	if opts.dryRun {
+		return pushOutcome{status: "Would create"}
+	}
+	r := sink.Create(docs, s)
+	if !r.ok() {
+		failures.write(name, r.Status, docs[s].General.Manufacturer, r.message())
+		return pushOutcome{status: r.Status, sent: true, code: r.Code}
+	}
+	state.record(name, key, r.Id, hash, opts.runId)
+	return pushOutcome{status: r.Status, sent: true, code: r.Code, pushed: &pushedDoc{index: s, id: r.Id}}
 }
 
+// updateDoc patches the record id with docs[s] and stores the new hash.
+func updateDoc(sink Sink, docs Docs, s int, id string, state *PushState, opts pushOptions, failures *failureLog) pushOutcome {
+	if opts.dryRun {
+		return pushOutcome{status: "Would update"}
+	}
+	name := sink.Name()
+	r := sink.Update(id, docs, s)
+	if !r.ok() {
+		failures.write(name, r.Status, docs[s].General.Manufacturer, r.message())
+		return pushOutcome{status: r.Status, sent: true, code: r.Code}
+	}
+	state.record(name, docKey(docs, s), id, docHash(docs, s), opts.runId)
+	return pushOutcome{status: "200 Updated", sent: true, code: r.Code, pushed: &pushedDoc{index: s, id: id}}
+}
+
+func countStatus(statCode string, link map[string]int) map[string]int {
+	if len(link) == 0 {
+		link[statCode] = 1
+	} else {
+		if _, ok := link[statCode]; ok {
+			link[statCode] = link[statCode] + 1
+		} else {
+			link[statCode] = 1
+		}
+	}
+	return link
+}
+
+// recordLookup is the outcome of asking the target whether a doc exists.
+type recordLookup int
+
+const (
+	recordMissing recordLookup = iota
+	recordExists
+	lookupFailed
+)
+
 func getDocs(path string) Docs{
 	raw, err := os.Open(path)
 	defer raw.Close()
@@ -498,7 +770,9 @@ func getDocs(path string) Docs{
 	byteRaw, _ := ioutil.ReadAll(raw)
 
 	var d Docs
-	json.Unmarshal(byteRaw, &d)
+	if err := json.Unmarshal(byteRaw, &d); err != nil {
+		log.Fatal("Unable to parse " + path + ", the reported error was: " + err.Error())
+	}
 	return d
 }
 
@@ -570,7 +844,7 @@ func getCtFromTrimsFile() []CrsTrims{
 	fmt.Println("getCtFromTrimsFile");
 	ct := []CrsTrims{}
 
-	trimsFile, err := os.Open("Data_2019_03_01/PS_Trims.csv")
+	trimsFile, err := os.Open(dataFile("PS_Trims.csv"))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -589,7 +863,7 @@ func getCfFromFeaturesFile() []CrsFeatures{
 	fmt.Println("getCfFromFeaturesFile");
 	cf := []CrsFeatures{}
 
-	featuresFile, err := os.Open("Data_2019_03_01/PS_Features.csv")
+	featuresFile, err := os.Open(dataFile("PS_Features.csv"))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -607,7 +881,7 @@ func getCfFromFeaturesFile() []CrsFeatures{
 func getCpFromPackagesFile() []CrsPackages{
 	cp := []CrsPackages{}
 
-	packagesFile, err := os.Open("Data_2019_03_01/pkgs.csv")
+	packagesFile, err := os.Open(dataFile("pkgs.csv"))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -626,7 +900,7 @@ func getCsdFromSampleDataFile() []CrsSample{
 	fmt.Println("getCsdFromSampleDataFile");
 	csd := []CrsSample{}
 
-	sampleFile, err := os.Open("Data_2019_03_01/PS_SampleData.csv")
+	sampleFile, err := os.Open(dataFile("PS_SampleData.csv"))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -646,7 +920,7 @@ func getCoFromOptionsFile() []CrsOptions{
 	fmt.Println("getCoFromOptionsFile");
 	co := []CrsOptions{}
 
-	optionsFile, err := os.Open("Data_2019_03_01/PS_Options.csv")
+	optionsFile, err := os.Open(dataFile("PS_Options.csv"))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -665,7 +939,7 @@ func getCpgFromPhotoGalleryFile() []CrsPhotoGallery{
 	fmt.Println("getCpgFromPhotoGalleryFile");
 	cpg := []CrsPhotoGallery{}
 
-	PhotoGalleryFile, err := os.Open("Data_2019_03_01/photogallery.csv")
+	PhotoGalleryFile, err := os.Open(dataFile("photogallery.csv"))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -684,7 +958,7 @@ func getCsFromSpecsFile() []CrsSpecs{
 	fmt.Println("getCsFromSpecsFile");
 	cs := []CrsSpecs{}
 
-	specsFile, err := os.Open("Data_2019_03_01/PS_Specs_withpkgs.csv")
+	specsFile, err := os.Open(dataFile("PS_Specs_withpkgs.csv"))
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -704,7 +978,7 @@ func getCaFromCategoryMappingFile() []CrsCategories{
 	fmt.Println("getCaFromCategoriesAvailableFile");
 	ca := []CrsCategories{}
 
-	CategoryMappingFile, err := os.Open("Data_2019_03_01/CategoryMapping.csv")
+	CategoryMappingFile, err := os.Open(dataFile("CategoryMapping.csv"))
  	if err != nil {
  		fmt.Println(err)
  	}
@@ -736,19 +1010,15 @@ func getCaFromCategoryMappingFile() []CrsCategories{
 // 	return mu
 // }
 
-func getMappedCategory(cat string, trimId string) string{
-	newCat:=""
-  // fmt.Println(cat)
-  ca :=getCaFromCategoryMappingFile()
-  for i:=0;i<len(ca);i++{
-    if ca[i].Value==cat && ca[i].TrimId==trimId {
-      fmt.Println("I am inside mapping category loop")
-      fmt.Println(ca[i].Value)
-			fmt.Println(ca[i].TrimId)
-      fmt.Println(ca[i].MappedCategory)
-      newCat = ca[i].MappedCategory
-    }}
-	return newCat
+var categoryMap *categoryMapping
+
+// getMappedCategory maps a CRS generic type to the target category, falling
+// back from the TrimId row to the ProdType and Value rows of CategoryMapping.csv.
+func getMappedCategory(cat string, trimId string, prodType string) string{
+	if categoryMap == nil {
+		categoryMap = newCategoryMapping(getCaFromCategoryMappingFile())
+	}
+	return categoryMap.lookup(cat, trimId, prodType)
 }
 
 func visit(files *[]string) filepath.WalkFunc {
@@ -784,24 +1054,57 @@ func charRemover(oldString string, oldChar string, newChar string) string {
 // 	return flag
 // }
 
+// feedBuild is the result of building docs from one CRS data directory;
+// trimIds[i] is the TrimId docs[i] was built from.
+type feedBuild struct {
+	docs           Docs
+	trimIds        []string
+	taxonomyIssues []TaxonomyIssue
+}
+
 func buildJson(){
+	b := buildDocs()
+	out, _ := json.Marshal(b.docs)
+	err := ioutil.WriteFile("./out.json", out, 0644)
+	if err != nil {
+		fmt.Println(err)
+	}
+	writeSelection("out.json")
+	writeTaxonomyReport("unmappedCategories.csv", b.taxonomyIssues)
+	writeMissingMediaReport("missingMedia.csv")
+}
+
+// buildCommand builds out.json without pushing it.
+func buildCommand(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	filterFlags := addTrimFilterFlags(fs)
+	fs.Parse(args)
+	selection = filterFlags.filter()
+	buildJson()
+}
+
+func buildDocs() feedBuild{
 	fmt.Println("im here")
-	ct:=getCtFromTrimsFile()
+	ct:=selection.trims(getCtFromTrimsFile())
 	cf:=getCfFromFeaturesFile()
 	csd:=getCsdFromSampleDataFile()
 	co :=getCoFromOptionsFile()
 	cs :=getCsFromSpecsFile()
 	cpg :=getCpgFromPhotoGalleryFile()
+	tx := loadTaxonomy()
+	var taxonomyIssues []TaxonomyIssue
 	d := make(Docs, len(ct), len(ct) )
+	trimIds := make([]string, len(ct))
 	// flag := false
 	// loop thrugh each trim (model) and build json
 	for t := 0; t < len(ct); t++ {
 		// flag:= checkIfOemUpdated(ct[t].ManufacturerName, ct[t].ModelName)
 		// if flag==false{
 			trimId := ct[t].TrimId
+			trimIds[t] = trimId
 			fmt.Println(t)
 			fmt.Println("trim id is" , trimId)
-			fmt.Println("\n")
+			fmt.Println()
 			d[t].Meta.Source = "CRS"
 			// d[t].Meta.Test = "Test Powersports-sneha-2019-03-07"
 			d[t].General.Manufacturer = ct[t].ManufacturerName
@@ -810,29 +1113,25 @@ func buildJson(){
 			d[t].General.Msrp = ct[t].Msrp
 			// building general
 			fmt.Println("general build");
+			genericType := ""
+			images := trimImages{trimPhoto: ct[t].TrimPhoto}
 			for sd := 0; sd < len(csd); sd++ {
 				mappedCategory:=""
 				if csd[sd].TrimId == trimId {
 					if csd[sd].FeatureName == "Identifiers" {
 						if csd[sd].AttributeName == "Generic Type (Primary)" {
-							 mappedCategory = getMappedCategory(csd[sd].Value, csd[sd].TrimId)
+							genericType = csd[sd].Value
+							 mappedCategory = getMappedCategory(csd[sd].Value, csd[sd].TrimId, ct[t].ProdType)
 							d[t].General.Category=mappedCategory
 							d[t].General.Description = "Description: " + d[t].General.Manufacturer+ " - " +mappedCategory
 						}
 						if csd[sd].AttributeName == "Manufacturer Country" {
-						 	d[t].General.Countries = append(d[t].General.Countries,csd[sd].Value)
-					 	} else{
-							countries:= []string{"US","CA"}
-							d[t].General.Countries = countries
-						}
+						 	d[t].General.ManufacturerCountry = csd[sd].Value
+					 	}
 						if csd[sd].AttributeName == "Generic Type 2" {
 							d[t].General.Subcategory = csd[sd].Value
-						}else {
-							d[t].General.Subcategory = d[t].General.Category
 						}
 						//extracting images
-						folder_name:= ""
-						image_name := ""
 						// if csd[sd].AttributeName == "Photo Name"&& flag == true{
 						// 	image_name = csd[sd].Value
 					 	// 	folder_name = "800x400"
@@ -846,44 +1145,49 @@ func buildJson(){
 					  //}
 
 					if csd[sd].AttributeName == "Photo Name" {
-							image_name = csd[sd].Value
-							folder_name = "800x400"
-							imgLinkAWS := "https://s3.amazonaws.com/cws-cdn-east/crs-ps-images/"+folder_name+"/"+image_name
-	 						img := Image{}
-	 						img.Src=imgLinkAWS
-							img.Src=strings.Replace(imgLinkAWS," ","%20",-1)
-	 					  img.Src = strings.Replace(img.Src," ","%20",-1)
-	 					  d[t].Images=append(d[t].Images,img)
+	 					  images.heroes=append(images.heroes,csd[sd].Value)
 					 }
 					 if csd[sd].AttributeName == "Photo Name (Floorplan)"{
-					 	 image_name = csd[sd].Value
-					 	 folder_name = "Floorplan800"
-					 	 imgLinkAWS := "https://s3.amazonaws.com/cws-cdn-east/crs-ps-images/"+folder_name+"/"+image_name
-					 	 img := Image{}
-					 	 img.Src=imgLinkAWS
-					 	 img.Src=strings.Replace(imgLinkAWS," ","%20",-1)
-					 	 img.Src = strings.Replace(img.Src," ","%20",-1)
-					 	 d[t].Images=append(d[t].Images,img)
+					 	 images.floorplans=append(images.floorplans,csd[sd].Value)
 					 }
 					}
 				}
 			}
 
+			if d[t].General.Subcategory == "" {
+				d[t].General.Subcategory = d[t].General.Category
+			}
+			d[t].General.Countries = getCountries(d[t].General.Manufacturer, d[t].General.Category)
+			reason := "no category mapping"
+			if tx != nil {
+				reason = tx.validate(d[t].General.Category, d[t].General.Subcategory)
+			} else if d[t].General.Category != "" {
+				reason = ""
+			}
+			if reason != "" {
+				taxonomyIssues = append(taxonomyIssues, TaxonomyIssue{
+					TrimId:       trimId,
+					Manufacturer: d[t].General.Manufacturer,
+					Model:        d[t].General.Model,
+					ProdType:     ct[t].ProdType,
+					GenericType:  genericType,
+					Category:     d[t].General.Category,
+					Subcategory:  d[t].General.Subcategory,
+					Reason:       reason,
+				})
+			}
+
 			//extracting images from photogallery file
 			fmt.Println("gallery build");
 			for pg :=0; pg< len(cpg); pg++{
 				if cpg[pg].TrimId == trimId {
 					fmt.Println(cpg[pg].PhotoName)
-					image_name := cpg[pg].PhotoName
-					folder_name := "gallery"
-					imgLinkAWS := "https://s3.amazonaws.com/cws-cdn-east/crs-ps-images/"+folder_name+"/"+image_name
-				 img := Image{}
-				 img.Src=imgLinkAWS
-				 img.Src=strings.Replace(imgLinkAWS," ","%20",-1)
-				img.Src = strings.Replace(img.Src," ","%20",-1)
-				d[t].Images=append(d[t].Images,img)
+				images.gallery=append(images.gallery,cpg[pg])
 				}
 			}
+			d[t].Videos, d[t].Attachments = getMedia(trimId)
+			d[t].Colors = getColors(ct, t)
+			d[t].Images = images.build(strconv.Itoa(d[t].General.Year)+" "+d[t].General.Manufacturer+" "+d[t].General.Model)
 
 			fmt.Println("specs build");
 			//building specs
@@ -1168,103 +1472,9 @@ func buildJson(){
 						}
 				}
 			}
-			out, _ := json.Marshal(d)
-			err := ioutil.WriteFile("./out.json", out, 0644)
-			if err != nil {
-				fmt.Println(err)
-		  }
 	//	}
 	}
-}
-
-func moveImagesBasedOnManuf(){
-		var files []string
-		err := copy.Copy("images_after_delete", "images_after_delete_Copy")
-		if err != nil {
-				panic(err)
-		}
-		err = filepath.Walk("images_after_delete_Copy", visit(&files))
-		if err != nil {
-				panic(err)
-		}
-		for _, file := range files {
-			os.Mkdir("sorted_images", 0777)
-			if (!strings.Contains(file,"ColorSwatches")){
-				splitPathArr:=strings.Split(file,"/")
-				if(len(splitPathArr) ==3){
-						splitFilenameArr:=strings.Split(splitPathArr[2],"_")
-						if (len(splitFilenameArr) >=4){
-								p:="sorted_images/"+splitFilenameArr[1]
-								if _, err := os.Stat(p); os.IsNotExist(err) {
-								    os.Mkdir(p, 0777)
-								}
-								p1:="sorted_images/"+splitFilenameArr[1]+"/"+splitFilenameArr[2]
-								if _, err := os.Stat(p1); os.IsNotExist(err) {
-										os.Mkdir(p1, 0777)
-								}
-								fName:=""
-								if(len(splitFilenameArr) ==4){
-										fName=splitFilenameArr[3]
-								}else{
-									for i:=3;i<len(splitFilenameArr);i++{
-										if(fName==""){
-											fName=splitFilenameArr[i]
-										}else{
-											fName=fName+"_"+splitFilenameArr[i]
-										}
-									}
-								}
-			      		err := os.Rename(file,p1+"/"+fName)
-								if err != nil {
-										panic(err)
-								}
-						}else if(len(splitFilenameArr) ==3){
-							p:="sorted_images/"+splitFilenameArr[1]
-							if _, err := os.Stat(p); os.IsNotExist(err) {
-									os.Mkdir(p, 0777)
-							}
-							err := os.Rename(file,p+"/"+splitFilenameArr[2])
-							if err != nil {
-									panic(err)
-							}
-						}
-				}
-			}else{
-					splitPathArr:=strings.Split(file,"/")
-					if (len(splitPathArr)>3){
-						oem:=splitPathArr[2]
-						fileName:=splitPathArr[3]
-						p:="sorted_images/"+oem
-						if _, err := os.Stat(p); os.IsNotExist(err) {
-								os.Mkdir(p, 0777)
-						}
-						err := os.Rename(file,p+"/"+fileName)
-						if err != nil {
-								panic(err)
-						}
-					}
-
-			}
-		}
-		os.RemoveAll("images_after_delete_Copy")
-}
-
-func getOnly2018Images(){
-	err := copy.Copy("all_images", "images_after_delete")
-	if err != nil {
-			panic(err)
-	}
-	var files []string
-	err = filepath.Walk("images_after_delete", visit(&files))
-	if err != nil {
-			panic(err)
-	}
-	for _, file := range files {
-		if(strings.Contains(file,"2018") || strings.Contains(file,"ColorSwatches") ){
-		}else{
-			os.Remove(file)
-		}
-	}
+	return feedBuild{docs: d, trimIds: trimIds, taxonomyIssues: taxonomyIssues}
 }
 
 func replaceSpecialCharacters(name string) string{
@@ -1292,7 +1502,55 @@ func getPackageName(package_id string) string{
 		return package_name
 }
 func main() {
-	getAPI()
+	config = loadConfig("config.json")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "build":
+			buildCommand(os.Args[2:])
+		case "verify-images":
+			verifyImagesCommand(os.Args[2:])
+		case "filter-images":
+			filterImagesCommand(os.Args[2:])
+		case "sort-images":
+			sortImagesCommand(os.Args[2:])
+		case "images":
+			imagesCommand(os.Args[2:])
+		case "validate":
+			validateCommand(os.Args[2:])
+		case "diff":
+			diffCommand(os.Args[2:])
+		case "retire":
+			retireCommand(os.Args[2:])
+		case "snapshot":
+			snapshotCommand(os.Args[2:])
+		case "promote":
+			promoteCommand(os.Args[2:])
+		case "mock-server":
+			mockServerCommand(os.Args[2:])
+		default:
+			fmt.Println("unknown command", os.Args[1])
+			fmt.Println("commands: build, verify-images, filter-images, sort-images, images process, validate, diff, retire, snapshot, promote, mock-server")
+			os.Exit(2)
+		}
+		return
+	}
+	var opts pushOptions
+	flag.BoolVar(&opts.verify, "verify", false, "read every created or updated record back and compare it with what was sent")
+	flag.StringVar(&opts.snapshot, "snapshot", "", "resolve existing records from this snapshot file instead of the target")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "report what would be created or updated without sending anything")
+	targets := flag.String("target", "", "comma separated configured targets to push to, asked for when empty")
+	flag.IntVar(&opts.workers, "workers", config.Push.Workers, "docs sent to each target at a time")
+	flag.IntVar(&opts.canary, "canary", 0, "push and read back this many representative docs before the rest")
+	flag.StringVar(&opts.canaryOnFailure, "canary-on-failure", config.Canary.OnFailure, "abort or pause when the canary fails")
+	flag.IntVar(&opts.resumeFrom, "resume-from", 0, "skip the docs before this index, as reported by an aborted push")
+	filterFlags := addTrimFilterFlags(flag.CommandLine)
+	flag.Parse()
+	if opts.canaryOnFailure != "abort" && opts.canaryOnFailure != "pause" {
+		fmt.Println("-canary-on-failure must be abort or pause")
+		os.Exit(2)
+	}
+	selection = filterFlags.filter()
+	opts.targets = pushTargets(*targets)
 	buildJson()
-	postJson()
+	postJson(opts)
 }
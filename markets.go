@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+)
+
+// MarketOverride restricts where a manufacturer, a category, or a
+// manufacturer within a category is sold. Either key may be left blank.
+// Countries is a list of country codes separated by spaces, commas or ";".
+type MarketOverride struct {
+	Manufacturer string `csv:"Manufacturer"`
+	Category     string `csv:"Category"`
+	Countries    string `csv:"Countries"`
+}
+
+type marketRules struct {
+	defaults  []string
+	overrides map[string][]string
+}
+
+var markets *marketRules
+
+func getMarketOverrides(path string) []MarketOverride {
+	fmt.Println("getMarketOverrides")
+	mo := []MarketOverride{}
+
+	overrideFile, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		return mo
+	}
+	defer overrideFile.Close()
+
+	if err := gocsv.UnmarshalFile(overrideFile, &mo); err != nil {
+		panic(err)
+	}
+	return mo
+}
+
+func newMarketRules(defaults []string, mo []MarketOverride) *marketRules {
+	m := &marketRules{defaults: defaults, overrides: make(map[string][]string)}
+	for _, o := range mo {
+		countries := strings.FieldsFunc(o.Countries, func(r rune) bool {
+			return r == ' ' || r == ',' || r == ';'
+		})
+		m.overrides[marketKey(o.Manufacturer, o.Category)] = countries
+	}
+	return m
+}
+
+func marketKey(manufacturer string, category string) string {
+	return strings.ToLower(strings.TrimSpace(manufacturer)) + "|" + strings.ToLower(strings.TrimSpace(category))
+}
+
+// countriesFor returns the markets of a model. The most specific override
+// wins: manufacturer and category, then manufacturer, then category.
+func (m *marketRules) countriesFor(manufacturer string, category string) []string {
+	for _, key := range []string{
+		marketKey(manufacturer, category),
+		marketKey(manufacturer, ""),
+		marketKey("", category),
+	} {
+		if countries, ok := m.overrides[key]; ok {
+			return append([]string(nil), countries...)
+		}
+	}
+	return append([]string(nil), m.defaults...)
+}
+
+func getCountries(manufacturer string, category string) []string {
+	if markets == nil {
+		markets = newMarketRules(config.Markets.Default, getMarketOverrides(config.Markets.OverrideFile))
+	}
+	return markets.countriesFor(manufacturer, category)
+}
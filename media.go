@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+)
+
+type Video struct {
+	Src      string `json:"src"`
+	Desc     string `json:"desc"`
+	Longdesc string `json:"longdesc"`
+}
+
+type Attachment struct {
+	AttachmentDescription     string `json:"attachmentDescription"`
+	AttachmentLocation        string `json:"attachmentLocation"`
+	AttachmentLongDescription string `json:"attachmentLongDescription"`
+}
+
+// CrsMedia is a row of the optional videos and attachments tables. Url is
+// used as is; otherwise File is a path under config.Media.Dir and is
+// linked through the CDN.
+type CrsMedia struct {
+	TrimId          string `csv:"TrimId"`
+	Url             string `csv:"Url"`
+	File            string `csv:"File"`
+	Description     string `csv:"Description"`
+	LongDescription string `csv:"LongDescription"`
+}
+
+// MissingMedia is one line of missingMedia.csv.
+type MissingMedia struct {
+	TrimId string
+	Kind   string
+	File   string
+}
+
+type mediaIndex struct {
+	videos      map[string][]CrsMedia
+	attachments map[string][]CrsMedia
+	missing     []MissingMedia
+}
+
+var media *mediaIndex
+
+func getCmFromMediaFile(path string) []CrsMedia {
+	fmt.Println("getCmFromMediaFile", path)
+	cm := []CrsMedia{}
+
+	mediaFile, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		return cm
+	}
+	defer mediaFile.Close()
+
+	if err := gocsv.UnmarshalFile(mediaFile, &cm); err != nil {
+		panic(err)
+	}
+	return cm
+}
+
+// scanMediaDir adds <dir>/<TrimId>/<sub>/<file> to rows of trims that
+// have no table entry for the same file.
+func scanMediaDir(dir string, sub string, rows map[string][]CrsMedia) {
+	trims, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, trim := range trims {
+		if !trim.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, trim.Name(), sub))
+		if err != nil {
+			continue
+		}
+		listed := make(map[string]bool)
+		for _, r := range rows[trim.Name()] {
+			listed[filepath.ToSlash(r.File)] = true
+		}
+		for _, f := range files {
+			rel := path.Join(trim.Name(), sub, f.Name())
+			if f.IsDir() || listed[rel] {
+				continue
+			}
+			desc := strings.Replace(strings.TrimSuffix(f.Name(), path.Ext(f.Name())), "_", " ", -1)
+			rows[trim.Name()] = append(rows[trim.Name()], CrsMedia{TrimId: trim.Name(), File: rel, Description: desc})
+		}
+	}
+}
+
+func newMediaIndex() *mediaIndex {
+	m := &mediaIndex{videos: make(map[string][]CrsMedia), attachments: make(map[string][]CrsMedia)}
+	for _, r := range getCmFromMediaFile(dataFile(config.Media.VideosFile)) {
+		m.videos[r.TrimId] = append(m.videos[r.TrimId], r)
+	}
+	for _, r := range getCmFromMediaFile(dataFile(config.Media.AttachmentsFile)) {
+		m.attachments[r.TrimId] = append(m.attachments[r.TrimId], r)
+	}
+	scanMediaDir(config.Media.Dir, "videos", m.videos)
+	scanMediaDir(config.Media.Dir, "attachments", m.attachments)
+	return m
+}
+
+// link returns the URL of a media row, recording it as missing when it
+// names a local file that doesn't exist.
+func (m *mediaIndex) link(r CrsMedia, kind string) (string, bool) {
+	if r.Url != "" {
+		return r.Url, true
+	}
+	if _, err := os.Stat(filepath.Join(config.Media.Dir, filepath.FromSlash(r.File))); err != nil {
+		m.missing = append(m.missing, MissingMedia{TrimId: r.TrimId, Kind: kind, File: r.File})
+		return "", false
+	}
+	return imageUrl(config.Media.Folder, r.File), true
+}
+
+func (m *mediaIndex) forTrim(trimId string) ([]Video, []Attachment) {
+	var videos []Video
+	var attachments []Attachment
+	for _, r := range m.videos[trimId] {
+		if src, ok := m.link(r, "video"); ok {
+			videos = append(videos, Video{Src: src, Desc: r.Description, Longdesc: r.LongDescription})
+		}
+	}
+	for _, r := range m.attachments[trimId] {
+		if loc, ok := m.link(r, "attachment"); ok {
+			attachments = append(attachments, Attachment{AttachmentDescription: r.Description, AttachmentLocation: loc, AttachmentLongDescription: r.LongDescription})
+		}
+	}
+	return videos, attachments
+}
+
+func getMedia(trimId string) ([]Video, []Attachment) {
+	if media == nil {
+		media = newMediaIndex()
+	}
+	return media.forTrim(trimId)
+}
+
+func writeMissingMediaReport(path string) {
+	deleteFile(path)
+	if media == nil || len(media.missing) == 0 {
+		return
+	}
+	missing := media.missing
+	sort.SliceStable(missing, func(i, j int) bool { return missing[i].TrimId < missing[j].TrimId })
+
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"TrimId", "Kind", "File"})
+	for _, mm := range missing {
+		writer.Write([]string{mm.TrimId, mm.Kind, mm.File})
+	}
+	writer.Flush()
+	fmt.Println(len(missing), "videos and attachments are missing, see", path)
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockDiscordia is an in-memory stand-in for Discordia and the Nebulous
+// token endpoint. It backs the push tests through httptest and the
+// mock-server command.
+type mockDiscordia struct {
+	mu    sync.Mutex
+	token string
+	// manufacturers, when set, are the only manufacturers records may have.
+	manufacturers map[string]bool
+	records       map[string]map[string]interface{}
+	nextId        int
+	faults        []*mockFault
+	// requests logs "METHOD path" of every request, for tests.
+	requests []string
+}
+
+// mockFault makes matching requests fail. Kind is an HTTP status such as
+// "429" or "500", or "timeout" to hold the request for Delay.
+type mockFault struct {
+	Method string
+	// Path, when set, is a prefix the request path must have.
+	Path string
+	Kind string
+	// Times is how many requests fail; 0 is every one.
+	Times int
+	// After is how many matching requests go through before the fault starts.
+	After int
+	Delay time.Duration
+	seen  int
+	used  int
+}
+
+func newMockDiscordia() *mockDiscordia {
+	return &mockDiscordia{token: "mock-token", records: make(map[string]map[string]interface{})}
+}
+
+// inject adds a fault; faults are tried in the order they were added.
+func (m *mockDiscordia) inject(f mockFault) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.faults = append(m.faults, &f)
+}
+
+// seed stores a record as if it had been posted and returns its _id.
+func (m *mockDiscordia) seed(doc interface{}) string {
+	mJ, _ := json.Marshal(doc)
+	var rec map[string]interface{}
+	json.Unmarshal(mJ, &rec)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store(rec)
+}
+
+func (m *mockDiscordia) store(rec map[string]interface{}) string {
+	m.nextId++
+	id := fmt.Sprintf("mock%06d", m.nextId)
+	rec["_id"] = id
+	m.records[id] = rec
+	return id
+}
+
+// count returns how many logged requests start with prefix, e.g. "POST".
+func (m *mockDiscordia) count(prefix string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, r := range m.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// targetConfig points a discordia target at the mock served at base.
+func (m *mockDiscordia) targetConfig(base string) TargetConfig {
+	return TargetConfig{Type: "discordia", Url: base + "/v1/model/", ModelsUrl: base + "/v1/models"}
+}
+
+func (m *mockDiscordia) fault(r *http.Request) *mockFault {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.faults {
+		if f.Method != "" && f.Method != "*" && f.Method != r.Method {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, f.Path) {
+			continue
+		}
+		if f.seen++; f.seen <= f.After {
+			continue
+		}
+		if f.Times > 0 && f.used >= f.Times {
+			continue
+		}
+		f.used++
+		return f
+	}
+	return nil
+}
+
+func writeMockJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func mockError(w http.ResponseWriter, code int, msg interface{}) {
+	writeMockJson(w, code, map[string]interface{}{"error": true, "msg": msg})
+}
+
+func (m *mockDiscordia) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.requests = append(m.requests, r.Method+" "+r.URL.Path)
+	m.mu.Unlock()
+
+	if f := m.fault(r); f != nil {
+		if f.Kind == "timeout" {
+			// The server only notices the client giving up once the body is read.
+			ioutil.ReadAll(r.Body)
+			select {
+			case <-time.After(f.Delay):
+			case <-r.Context().Done():
+				return
+			}
+			mockError(w, http.StatusGatewayTimeout, "Timed out")
+			return
+		}
+		code, _ := strconv.Atoi(f.Kind)
+		mockError(w, code, http.StatusText(code))
+		return
+	}
+
+	if r.URL.Path == "/token" {
+		m.serveToken(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != m.token {
+		mockError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	switch {
+	case r.URL.Path == "/v1/models" && r.Method == "GET":
+		m.serveModels(w, r)
+	case (r.URL.Path == "/v1/model" || r.URL.Path == "/v1/model/") && r.Method == "POST":
+		m.serveCreate(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/model/"):
+		m.serveRecord(w, r, strings.TrimPrefix(r.URL.Path, "/v1/model/"))
+	default:
+		mockError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (m *mockDiscordia) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		mockError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil || r.FormValue("client_id") == "" {
+		mockError(w, http.StatusBadRequest, "client_id is required")
+		return
+	}
+	writeMockJson(w, http.StatusOK, Token{AccessToken: m.token, ExpiresIn: 3600, TokenType: "Bearer"})
+}
+
+func mockGeneral(rec map[string]interface{}) map[string]interface{} {
+	g, _ := rec["general"].(map[string]interface{})
+	return g
+}
+
+func mockField(rec map[string]interface{}, key string) string {
+	switch v := mockGeneral(rec)[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.Itoa(int(v))
+	}
+	return ""
+}
+
+// serveModels answers a lookup when any of manufacturer, category,
+// subcategory, year or model is given, and otherwise lists records a page
+// at a time, optionally by meta.source.
+func (m *mockDiscordia) serveModels(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(m.records))
+	for id := range m.records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var matches []map[string]interface{}
+	for _, id := range ids {
+		rec := m.records[id]
+		keep := true
+		for _, key := range []string{"manufacturer", "category", "subcategory", "year", "model"} {
+			if v := q.Get(key); v != "" && !strings.EqualFold(v, mockField(rec, key)) {
+				keep = false
+			}
+		}
+		if source := q.Get("source"); source != "" {
+			meta, _ := rec["meta"].(map[string]interface{})
+			if meta["source"] != source {
+				keep = false
+			}
+		}
+		if keep {
+			matches = append(matches, rec)
+		}
+	}
+
+	if q.Get("page") != "" || q.Get("limit") != "" {
+		page, _ := strconv.Atoi(q.Get("page"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		if page < 1 {
+			page = 1
+		}
+		if limit < 1 {
+			limit = len(matches)
+		}
+		start, end := (page-1)*limit, page*limit
+		if start > len(matches) {
+			start = len(matches)
+		}
+		if end > len(matches) {
+			end = len(matches)
+		}
+		matches = matches[start:end]
+	}
+	if matches == nil {
+		matches = []map[string]interface{}{}
+	}
+	writeMockJson(w, http.StatusOK, map[string]interface{}{"data": matches})
+}
+
+// validate is Discordia's manufacturer check.
+func (m *mockDiscordia) validate(rec map[string]interface{}) map[string][]string {
+	if m.manufacturers == nil || m.manufacturers[mockField(rec, "manufacturer")] {
+		return nil
+	}
+	return map[string][]string{"general.manufacturer": {"Manufacturer was not found."}}
+}
+
+func readMockBody(r *http.Request) (map[string]interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return nil, errors.New("body is not a JSON object")
+	}
+	return rec, nil
+}
+
+func (m *mockDiscordia) serveCreate(w http.ResponseWriter, r *http.Request) {
+	rec, err := readMockBody(r)
+	if err != nil {
+		mockError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg := m.validate(rec); msg != nil {
+		mockError(w, http.StatusUnprocessableEntity, msg)
+		return
+	}
+	m.store(rec)
+	writeMockJson(w, http.StatusCreated, map[string]interface{}{"data": rec})
+}
+
+func (m *mockDiscordia) serveRecord(w http.ResponseWriter, r *http.Request, id string) {
+	m.mu.Lock()
+	rec, ok := m.records[id]
+	m.mu.Unlock()
+	if !ok {
+		mockError(w, http.StatusNotFound, "Model "+id+" was not found.")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		m.mu.Lock()
+		out, _ := json.Marshal(map[string]interface{}{"data": rec})
+		m.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	case "PATCH":
+		patch, err := readMockBody(r)
+		if err != nil {
+			mockError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		merged := mergeMockJson(copyMockJson(rec), patch)
+		if msg := m.validate(merged); msg != nil {
+			mockError(w, http.StatusUnprocessableEntity, msg)
+			return
+		}
+		merged["_id"] = id
+		m.records[id] = merged
+		writeMockJson(w, http.StatusOK, map[string]interface{}{"data": merged})
+	case "DELETE":
+		m.mu.Lock()
+		delete(m.records, id)
+		m.mu.Unlock()
+		writeMockJson(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"_id": id}})
+	default:
+		mockError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func copyMockJson(rec map[string]interface{}) map[string]interface{} {
+	mJ, _ := json.Marshal(rec)
+	var out map[string]interface{}
+	json.Unmarshal(mJ, &out)
+	return out
+}
+
+// mergeMockJson applies a PATCH body: objects merge key by key, anything
+// else replaces.
+func mergeMockJson(dst map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	for k, v := range patch {
+		sub, isObj := v.(map[string]interface{})
+		cur, curObj := dst[k].(map[string]interface{})
+		if isObj && curObj {
+			dst[k] = mergeMockJson(cur, sub)
+		} else {
+			dst[k] = v
+		}
+	}
+	return dst
+}
+
+// parseMockFaults reads -fail values like "POST:500:3,GET@/v1/models:429:1:1"
+// into faults: METHOD[@PATH]:KIND[:TIMES[:AFTER]].
+func parseMockFaults(value string, delay time.Duration) ([]mockFault, error) {
+	var faults []mockFault
+	for _, spec := range strings.Split(value, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, errors.New(spec + " is not METHOD[@PATH]:KIND[:TIMES[:AFTER]]")
+		}
+		f := mockFault{Method: parts[0], Kind: parts[1], Delay: delay, Times: 1}
+		if i := strings.Index(f.Method, "@"); i >= 0 {
+			f.Method, f.Path = f.Method[:i], f.Method[i+1:]
+		}
+		if f.Kind != "timeout" {
+			if code, err := strconv.Atoi(f.Kind); err != nil || code < 400 || code > 599 {
+				return nil, errors.New(spec + ": kind must be timeout or a 4xx/5xx status")
+			}
+		}
+		if len(parts) >= 3 {
+			times, err := strconv.Atoi(parts[2])
+			if err != nil || times < 0 {
+				return nil, errors.New(spec + ": times must be a number, 0 for always")
+			}
+			f.Times = times
+		}
+		if len(parts) == 4 {
+			after, err := strconv.Atoi(parts[3])
+			if err != nil || after < 0 {
+				return nil, errors.New(spec + ": after must be a number")
+			}
+			f.After = after
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+// mockServerCommand serves the mock on -addr. Pointing the
+// discordia-stage target and nebulous.tokenUrl at it runs a full push
+// offline.
+func mockServerCommand(args []string) {
+	fs := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:5000", "listen address")
+	manufacturers := fs.String("manufacturers", "", "comma separated manufacturers to accept, any when empty")
+	fail := fs.String("fail", "", "faults to inject, METHOD[@PATH]:KIND[:TIMES[:AFTER]] comma separated, e.g. POST:500:3,GET@/v1/models:timeout:1:1")
+	delay := fs.Duration("timeout-delay", 2*time.Minute, "how long a timeout fault holds the request")
+	seed := fs.String("seed", "", "docs JSON file to preload, such as out.json")
+	fs.Parse(args)
+
+	m := newMockDiscordia()
+	if *manufacturers != "" {
+		m.manufacturers = make(map[string]bool)
+		for _, name := range strings.Split(*manufacturers, ",") {
+			m.manufacturers[strings.TrimSpace(name)] = true
+		}
+	}
+	faults, err := parseMockFaults(*fail, *delay)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range faults {
+		m.inject(f)
+	}
+	if *seed != "" {
+		docs := getDocs(*seed)
+		for s := range docs {
+			docs[s].Id = ""
+			m.seed(docs[s])
+		}
+		fmt.Println("seeded", len(docs), "records from", *seed)
+	}
+	fmt.Println("mock Discordia on http://"+*addr+"/v1/model/, token at http://"+*addr+"/token, token is", m.token)
+	log.Fatal(http.ListenAndServe(*addr, m))
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withMock serves a fresh mock, points the token endpoint and the
+// discordia-stage target at it and runs the test in a scratch directory.
+func withMock(t *testing.T) *mockDiscordia {
+	m := newMockDiscordia()
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = defaultConfig()
+	config.Nebulous.TokenUrl = srv.URL + "/token"
+	config.Targets = map[string]TargetConfig{"discordia-stage": m.targetConfig(srv.URL)}
+	config.Target.TimeoutSeconds = 2
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return m
+}
+
+func testDocs(n int) Docs {
+	docs := make(Docs, n)
+	for s := range docs {
+		docs[s].Meta.Source = "CRS"
+		docs[s].General.Manufacturer = "Polaris"
+		docs[s].General.Year = 2019
+		docs[s].General.Model = "Sportsman " + strconv.Itoa(s)
+		docs[s].General.Category = "ATV"
+		docs[s].General.Subcategory = "ATV"
+		docs[s].General.Msrp = 8199
+	}
+	return docs
+}
+
+// push runs a push of docs to the mock and returns its Report.csv rows
+// by status.
+func push(t *testing.T, docs Docs, opts pushOptions) map[string]string {
+	if opts.workers == 0 {
+		opts.workers = 1
+	}
+	pushRun(opts, []pushBatch{{target: "discordia-stage", docs: docs}}, nil, ObtainNebulousToken())
+	f, err := os.Open("Report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := make(map[string]string)
+	for _, row := range rows {
+		if len(row) > 1 {
+			report[row[0]] = strings.Join(row[1:], ",")
+		}
+	}
+	return report
+}
+
+func TestObtainNebulousToken(t *testing.T) {
+	m := withMock(t)
+	if got := ObtainNebulousToken(); got != m.token {
+		t.Fatalf("token = %q, want %q", got, m.token)
+	}
+	m.inject(mockFault{Method: "POST", Path: "/token", Kind: "500", Times: 1})
+	if got := ObtainNebulousToken(); got != "" {
+		t.Fatalf("token after a 500 = %q, want none", got)
+	}
+}
+
+func TestPushCreatesThenSkipsUnchanged(t *testing.T) {
+	m := withMock(t)
+	docs := testDocs(3)
+	if report := push(t, docs, pushOptions{}); report["201 Created"] != "3" {
+		t.Fatalf("first push report = %v, want 3 created", report)
+	}
+	report := push(t, docs, pushOptions{})
+	if report["Unchanged"] != "3" {
+		t.Fatalf("second push report = %v, want 3 unchanged", report)
+	}
+	if n := m.count("POST /v1/model"); n != 3 {
+		t.Fatalf("%d POSTs, want 3", n)
+	}
+}
+
+func TestPushPatchesChangedDocs(t *testing.T) {
+	m := withMock(t)
+	docs := testDocs(2)
+	push(t, docs, pushOptions{})
+	docs[1].General.Msrp = 9999
+	if report := push(t, docs, pushOptions{}); report["200 Updated"] != "1" || report["Unchanged"] != "1" {
+		t.Fatalf("report = %v, want 1 updated and 1 unchanged", report)
+	}
+	if n := m.count("PATCH"); n != 1 {
+		t.Fatalf("%d PATCHes, want 1", n)
+	}
+	for _, rec := range m.records {
+		if mockField(rec, "model") == docs[1].General.Model && mockGeneral(rec)["msrp"] != 9999.0 {
+			t.Fatalf("patched msrp = %v, want 9999", mockGeneral(rec)["msrp"])
+		}
+	}
+}
+
+func TestPushReportsUnknownManufacturer(t *testing.T) {
+	m := withMock(t)
+	m.manufacturers = map[string]bool{"Polaris": true}
+	docs := testDocs(2)
+	docs[1].General.Manufacturer = "Acme"
+	report := push(t, docs, pushOptions{})
+	if report["201 Created"] != "1" || report["422 Unprocessable Entity"] != "1" {
+		t.Fatalf("report = %v, want 1 created and 1 rejected", report)
+	}
+	failures, _ := ioutil.ReadFile("nonExistingManufacturers.csv")
+	if !strings.Contains(string(failures), "Acme,general.manufacturer: Manufacturer was not found.") {
+		t.Fatalf("nonExistingManufacturers.csv = %q", failures)
+	}
+}
+
+func TestPushPatchesRecordsMissingFromState(t *testing.T) {
+	m := withMock(t)
+	docs := testDocs(2)
+	m.seed(docs[0])
+	docs[0].General.Msrp = 9999
+	if report := push(t, docs, pushOptions{}); report["200 Updated"] != "1" || report["201 Created"] != "1" {
+		t.Fatalf("report = %v, want 1 updated and 1 created", report)
+	}
+	if n := m.count("POST /v1/model"); n != 1 {
+		t.Fatalf("%d POSTs, want 1", n)
+	}
+	if n := m.count("PATCH"); n != 1 {
+		t.Fatalf("%d PATCHes, want 1", n)
+	}
+	if report := push(t, docs, pushOptions{}); report["Unchanged"] != "2" {
+		t.Fatalf("second push report = %v, want 2 unchanged", report)
+	}
+}
+
+func TestPushResolvesIdsFromSnapshot(t *testing.T) {
+	m := withMock(t)
+	docs := testDocs(3)
+	for s := range docs {
+		m.seed(docs[s])
+	}
+	snap := &catalogSnapshot{byKey: make(map[string]int)}
+	for _, rec := range m.records {
+		one := make(Docs, 1)
+		raw, _ := json.Marshal(rec)
+		json.Unmarshal(raw, &one[0])
+		snap.docs = append(snap.docs, one[0])
+		snap.byKey[docKey(one, 0)] = len(snap.docs) - 1
+	}
+	docs[2].General.Msrp = 9999
+	pushRun(pushOptions{workers: 1}, []pushBatch{{target: "discordia-stage", docs: docs}}, snap, ObtainNebulousToken())
+	// Only the health check asks the target.
+	if n := m.count("GET /v1/models"); n != 1 {
+		t.Fatalf("%d model GETs with a snapshot, want 1", n)
+	}
+	if n := m.count("PATCH"); n != 1 {
+		t.Fatalf("%d PATCHes, want 1", n)
+	}
+	if report := push(t, docs, pushOptions{}); report["Unchanged"] != "3" {
+		t.Fatalf("report after the snapshot push = %v, want 3 unchanged", report)
+	}
+}
+
+func TestDecodeLookup(t *testing.T) {
+	cases := []struct {
+		body   string
+		status recordLookup
+		id     string
+	}{
+		{`{"data":[{"_id":"abc"}]}`, recordExists, "abc"},
+		{`{"data":[]}`, recordMissing, ""},
+		{`{"error":true,"msg":"Model not found"}`, recordMissing, ""},
+		{`{"data":[{"general":{"model":"Sportsman"}}]}`, lookupFailed, ""},
+		{`<html>Bad Gateway</html>`, lookupFailed, ""},
+	}
+	for _, c := range cases {
+		status, id, _ := decodeLookup(SinkResult{Status: "200 OK", Code: 200, Body: c.body})
+		if status != c.status || id != c.id {
+			t.Errorf("decodeLookup(%s) = %v, %q, want %v, %q", c.body, status, id, c.status, c.id)
+		}
+	}
+}
+
+func TestPushDoesNotPostWhenLookupFails(t *testing.T) {
+	m := withMock(t)
+	// The first GET of the models is the health check.
+	m.inject(mockFault{Method: "GET", Path: "/v1/models", Kind: "500", Times: 1, After: 1})
+	report := push(t, testDocs(3), pushOptions{})
+	if report["Lookup failed"] != "1" || report["201 Created"] != "2" {
+		t.Fatalf("report = %v, want 1 lookup failure and 2 created", report)
+	}
+	if n := m.count("POST /v1/model"); n != 2 {
+		t.Fatalf("%d POSTs, want 2", n)
+	}
+}
+
+func TestPushStopsUnhealthyTarget(t *testing.T) {
+	m := withMock(t)
+	m.inject(mockFault{Method: "GET", Path: "/v1/models", Kind: "500", Times: 1})
+	report := push(t, testDocs(3), pushOptions{})
+	if !strings.Contains(report["Stopped"], "health check returned 500") {
+		t.Fatalf("report = %v, want the unhealthy target stopped", report)
+	}
+	if n := m.count("POST /v1/model"); n != 0 {
+		t.Fatalf("%d POSTs to an unhealthy target", n)
+	}
+}
+
+func TestPushCountsRateLimitedDocs(t *testing.T) {
+	m := withMock(t)
+	m.inject(mockFault{Method: "POST", Path: "/v1/model", Kind: "429", Times: 1})
+	report := push(t, testDocs(3), pushOptions{})
+	if report["429 Too Many Requests"] != "1" || report["201 Created"] != "2" {
+		t.Fatalf("report = %v, want 1 rate limited and 2 created", report)
+	}
+	// The rate limited doc isn't in the state, so the next push sends it.
+	if report := push(t, testDocs(3), pushOptions{}); report["201 Created"] != "1" || report["Unchanged"] != "2" {
+		t.Fatalf("retry report = %v, want 1 created and 2 unchanged", report)
+	}
+}
+
+func TestPushTimesOut(t *testing.T) {
+	m := withMock(t)
+	config.Target.TimeoutSeconds = 0.2
+	m.inject(mockFault{Method: "POST", Path: "/v1/model", Kind: "timeout", Times: 1, Delay: 5 * time.Second})
+	report := push(t, testDocs(2), pushOptions{})
+	if report["error"] != "1" || report["201 Created"] != "1" {
+		t.Fatalf("report = %v, want 1 timed out and 1 created", report)
+	}
+}
+
+func TestPushAbortsOnConsecutive5xx(t *testing.T) {
+	m := withMock(t)
+	config.Abort.MaxConsecutive5xx = 2
+	m.inject(mockFault{Method: "POST", Path: "/v1/model", Kind: "500"})
+	report := push(t, testDocs(10), pushOptions{})
+	if !strings.Contains(report["Stopped"], "3 consecutive 5xx") {
+		t.Fatalf("report = %v, want a stop after 3 5xx", report)
+	}
+	// Docs 0 to 2 failed, so a resume has to send them again.
+	if report["Resume from"] != "0,Polaris,2019,Sportsman 0" {
+		t.Fatalf("resume = %q, want doc 0", report["Resume from"])
+	}
+	if n := m.count("POST /v1/model"); n != 3 {
+		t.Fatalf("%d POSTs, want 3", n)
+	}
+}
+
+func TestPushAbortsOn5xxBetweenUnchangedDocs(t *testing.T) {
+	m := withMock(t)
+	config.Abort.MaxConsecutive5xx = 2
+	docs := testDocs(6)
+	push(t, Docs{docs[0], docs[2], docs[4]}, pushOptions{})
+	m.inject(mockFault{Method: "POST", Path: "/v1/model", Kind: "500"})
+	report := push(t, docs, pushOptions{})
+	if !strings.Contains(report["Stopped"], "3 consecutive 5xx") {
+		t.Fatalf("report = %v, want a stop after 3 5xx with unchanged docs in between", report)
+	}
+}
+
+func TestPushAbortsOnAuthError(t *testing.T) {
+	m := withMock(t)
+	m.inject(mockFault{Method: "POST", Path: "/v1/model", Kind: "401"})
+	report := push(t, testDocs(5), pushOptions{})
+	if !strings.Contains(report["Stopped"], "auth error") || report["Resume from"] == "" {
+		t.Fatalf("report = %v, want a stop on the auth error", report)
+	}
+	if n := m.count("POST /v1/model"); n != 1 {
+		t.Fatalf("%d POSTs, want 1", n)
+	}
+}
+
+func TestPushVerifiesReadBack(t *testing.T) {
+	withMock(t)
+	report := push(t, testDocs(3), pushOptions{verify: true})
+	if report["Verified"] != "3" || report["Verification mismatches"] != "0" {
+		t.Fatalf("report = %v, want 3 verified without mismatches", report)
+	}
+}
+
+func TestListPagesThroughRecords(t *testing.T) {
+	m := withMock(t)
+	config.Target.PageSize = 2
+	docs := testDocs(5)
+	for s := range docs {
+		m.seed(docs[s])
+	}
+	lister := newSink("discordia-stage", m.token).(recordLister)
+	if got := lister.List("CRS"); len(got) != 5 {
+		t.Fatalf("listed %d records, want 5", len(got))
+	}
+}
+
+func TestParseMockFaults(t *testing.T) {
+	faults, err := parseMockFaults("POST:500:3,GET@/v1/models:timeout:1:2", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(faults) != 2 || faults[0].Times != 3 || faults[1].Path != "/v1/models" || faults[1].Times != 1 || faults[1].After != 2 {
+		t.Fatalf("faults = %+v", faults)
+	}
+	if _, err := parseMockFaults("POST:200", time.Second); err == nil {
+		t.Fatal("a 200 fault was accepted")
+	}
+}
+
+func TestIgneousSendsJsonSpecs(t *testing.T) {
+	var contentType string
+	var body IgneousSpec
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"_id":"spec-1"}`))
+	}))
+	defer srv.Close()
+
+	docs := testDocs(1)
+	docs[0].Weights = map[string]Specs{"dryWeight": {Desc: "1000 lbs", Label: "Dry Weight"}}
+	sink := &igneousSink{name: "igneous-stage", cfg: TargetConfig{Type: "igneous", Url: srv.URL + "/specs"}}
+	if r := sink.Create(docs, 0); !r.ok() || r.Id != "spec-1" {
+		t.Fatalf("create = %+v", r)
+	}
+	if contentType != "application/json" {
+		t.Fatalf("Content-Type = %q", contentType)
+	}
+	want := IgneousSpecRow{Group: "weights", Key: "dryWeight", Label: "Dry Weight", Value: "1000 lbs"}
+	if body.Manufacturer != "Polaris" || len(body.Specs) != 1 || body.Specs[0] != want {
+		t.Fatalf("body = %+v", body)
+	}
+}
+
+func TestPromoteUsesLatestBuildRun(t *testing.T) {
+	m := withMock(t)
+	prod := newMockDiscordia()
+	srv := httptest.NewServer(prod)
+	defer srv.Close()
+	config.Targets["discordia-prod"] = prod.targetConfig(srv.URL)
+
+	push(t, testDocs(2), pushOptions{})
+	promoteCommand([]string{"-workers", "1"})
+	// A second promotion without -run passes over the first one's own run.
+	promoteCommand([]string{"-workers", "1"})
+	if n := m.count("POST /v1/model"); n != 2 {
+		t.Fatalf("%d POSTs to stage, want 2", n)
+	}
+	if len(prod.records) != 2 {
+		t.Fatalf("prod has %d records, want 2", len(prod.records))
+	}
+}
+
+func TestCanaryStartsAtResumePoint(t *testing.T) {
+	m := withMock(t)
+	report := push(t, testDocs(4), pushOptions{canary: 2, canaryOnFailure: "abort", resumeFrom: 2})
+	if n := m.count("POST /v1/model"); n != 2 {
+		t.Fatalf("%d POSTs, want the 2 docs after the resume point", n)
+	}
+	if report["201 Created"] != "2" {
+		t.Fatalf("report = %v, want 2 created", report)
+	}
+}
+
+func TestCanaryAbortResumesAtFirstUntriedDoc(t *testing.T) {
+	m := withMock(t)
+	docs := testDocs(3)
+	docs[2].General.Manufacturer = "Honda"
+	// The sample is docs 0 and 2; doc 2 fails and doc 1 is never tried.
+	m.inject(mockFault{Method: "POST", Path: "/v1/model", Kind: "500", Times: 1, After: 1})
+	report := push(t, docs, pushOptions{canary: 2, canaryOnFailure: "abort"})
+	if report["Resume from"] != "1,Polaris,2019,Sportsman 1" {
+		t.Fatalf("resume = %q, want doc 1", report["Resume from"])
+	}
+}
+
+func TestCanaryReportsAbortedSample(t *testing.T) {
+	m := withMock(t)
+	config.Abort.MaxConsecutive5xx = 1
+	m.inject(mockFault{Method: "POST", Path: "/v1/model", Kind: "500"})
+	report := push(t, testDocs(5), pushOptions{canary: 4, canaryOnFailure: "abort"})
+	if report["Canary"] != "2" || report["Canary failures"] != "2" {
+		t.Fatalf("report = %v, want 2 canary docs tried and failed", report)
+	}
+}
+
+func TestRetireSkipsInactiveRecords(t *testing.T) {
+	m := withMock(t)
+	docs := testDocs(3)
+	for s := range docs {
+		m.seed(docs[s])
+	}
+	out, _ := json.Marshal(docs[:1])
+	if err := ioutil.WriteFile("out.json", out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	retireCommand([]string{"-target", "discordia-stage", "-mode", "inactive", "-max", "2"})
+	// The second run finds both records already inactive, so the cap isn't hit
+	// and nothing is patched again.
+	retireCommand([]string{"-target", "discordia-stage", "-mode", "inactive", "-max", "2"})
+	if n := m.count("PATCH"); n != 2 {
+		t.Fatalf("%d PATCHes over two runs, want 2", n)
+	}
+	report, _ := ioutil.ReadFile("retired.csv")
+	if strings.Count(string(report), "\n") != 1 {
+		t.Fatalf("second retired.csv = %q, want only the header", report)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// ModelsPage is one page of the target's models listing.
+type ModelsPage struct {
+	Data Docs `json:"data"`
+}
+
+// retireCommand reconciles the target against the current build: CRS
+// records on the target that the build no longer has are reported, marked
+// inactive or deleted. A run that would touch more than -max records
+// changes nothing.
+func retireCommand(args []string) {
+	fs := flag.NewFlagSet("retire", flag.ExitOnError)
+	docsPath := fs.String("docs", "out.json", "current build")
+	mode := fs.String("mode", config.Retire.Mode, "report, inactive or delete")
+	max := fs.Int("max", config.Retire.MaxChanges, "most records one run may mark inactive or delete")
+	report := fs.String("report", "retired.csv", "report file")
+	targetName := fs.String("target", "", "configured target, asked for when empty")
+	filterFlags := addTrimFilterFlags(fs)
+	fs.Parse(args)
+	if *mode != "report" && *mode != "inactive" && *mode != "delete" {
+		fmt.Println("-mode must be report, inactive or delete")
+		os.Exit(2)
+	}
+	// Records that left the feed have no trim to look up, so only the fields
+	// they carry can scope a retire.
+	filter := filterFlags.filter()
+	if filter != nil && (filter.prodTypes != nil || filter.makeIds != nil || filter.trimIds != nil) {
+		fmt.Println("retire can only be scoped by -manufacturer and -year")
+		os.Exit(2)
+	}
+	// A filtered build leaves everything outside its selection out of the
+	// docs, which would all look retired unless retire is scoped the same way.
+	if built := builtSelection(*docsPath); built != filter.String() {
+		if built == "" {
+			log.Fatal(*docsPath + " is a full build; run retire without filter flags")
+		}
+		log.Fatal(*docsPath + " was built with " + built + "; run retire with the same filter flags, or against a full build")
+	}
+
+	sink := newSink(chooseTarget(*targetName), ObtainNebulousToken())
+	lister, ok := sink.(recordLister)
+	if !ok {
+		log.Fatal("Target " + sink.Name() + " cannot list its records")
+	}
+	inactive, canDeactivate := sink.(deactivator)
+	if *mode == "inactive" && !canDeactivate {
+		log.Fatal("Target " + sink.Name() + " cannot mark records inactive")
+	}
+	docs := getDocs(*docsPath)
+	current := make(map[string]bool)
+	for s := range docs {
+		current[docKey(docs, s)] = true
+	}
+
+	remote := lister.List("CRS")
+	var stale []int
+	for s := range remote {
+		if filter != nil && !filter.matchDoc(remote, s) {
+			continue
+		}
+		// Records an earlier run marked inactive are done with, unless they
+		// are to be deleted.
+		if *mode != "delete" && alreadyInactive(remote, s) {
+			continue
+		}
+		if remote[s].Meta.Source == "CRS" && !current[docKey(remote, s)] {
+			stale = append(stale, s)
+		}
+	}
+
+	action := *mode
+	if action != "report" && len(stale) > *max {
+		fmt.Println(len(stale), "records are no longer in the feed, more than the cap of", *max, "- nothing was changed")
+		action = "report"
+	}
+
+	state := loadPushState(config.State.File)
+	defer state.save(config.State.File)
+
+	deleteFile(*report)
+	createFile(*report)
+	f, err := os.OpenFile(*report, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"Action", "Status", "Id", "Manufacturer", "Year", "Model", "Response"})
+
+	link := make(map[string]int)
+	for _, s := range stale {
+		var r SinkResult
+		switch action {
+		case "inactive":
+			r = inactive.Deactivate(remote[s].Id)
+		case "delete":
+			r = sink.Delete(remote[s].Id)
+			if r.ok() {
+				delete(state.target(sink.Name()), docKey(remote, s))
+			}
+		}
+		bodyString := r.Body
+		if !r.ok() && r.Err != nil {
+			bodyString = r.message()
+		}
+		link = countStatus(action+" "+r.Status, link)
+		writer.Write([]string{action, r.Status, remote[s].Id, remote[s].General.Manufacturer, strconv.Itoa(remote[s].General.Year), remote[s].General.Model, bodyString})
+		writer.Flush()
+	}
+	writer.Flush()
+	for key, value := range link {
+		fmt.Println(key, value)
+	}
+}
+
+// alreadyInactive reports whether the record already holds every value
+// config.Retire.InactivePatch sets.
+func alreadyInactive(remote Docs, s int) bool {
+	var patch interface{}
+	if err := json.Unmarshal([]byte(config.Retire.InactivePatch), &patch); err != nil {
+		log.Fatal("Unable to parse retire.inactivePatch, the reported error was: " + err.Error())
+	}
+	mJ, _ := json.Marshal(remote[s])
+	var record interface{}
+	json.Unmarshal(mJ, &record)
+	return len(compareSent(patch, record, "")) == 0
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocarina/gocsv"
+)
+
+// ApprovedRecord is one line of a promote -approved file.
+type ApprovedRecord struct {
+	Manufacturer string `csv:"Manufacturer"`
+	Year         int    `csv:"Year"`
+	Model        string `csv:"Model"`
+}
+
+func newRunId() string {
+	return time.Now().UTC().Format("20060102T150405.000Z")
+}
+
+// runDir holds, per target, the docs a push run left on it.
+func runDir(runId string) string {
+	return filepath.Join(config.Runs.Dir, runId)
+}
+
+// archiveRun writes <runDir>/<target>.ndjson with the docs the target
+// accepted in this run.
+func archiveRun(runId string, run *targetRun) {
+	if err := os.MkdirAll(runDir(runId), 0755); err != nil {
+		log.Fatal(err)
+	}
+	var accepted Docs
+	for _, s := range run.accepted {
+		accepted = append(accepted, run.docs[s])
+	}
+	path := filepath.Join(runDir(runId), run.sink.Name()+".ndjson")
+	writeSnapshot(path, accepted)
+	fmt.Println("kept", len(accepted), run.sink.Name(), "docs in", path)
+}
+
+// RunInfo is <runDir>/run.json. Runs archived before it existed are
+// pushes of a build.
+type RunInfo struct {
+	// Kind is push or promote.
+	Kind         string `json:"kind"`
+	PromotedFrom string `json:"promotedFrom,omitempty"`
+}
+
+func writeRunInfo(opts pushOptions) {
+	info := RunInfo{Kind: "push"}
+	if opts.promotedFrom != "" {
+		info = RunInfo{Kind: "promote", PromotedFrom: opts.promotedFrom}
+	}
+	if err := os.MkdirAll(runDir(opts.runId), 0755); err != nil {
+		log.Fatal(err)
+	}
+	out, _ := json.MarshalIndent(info, "", "  ")
+	if err := ioutil.WriteFile(filepath.Join(runDir(opts.runId), "run.json"), out, 0644); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func readRunInfo(runId string) RunInfo {
+	info := RunInfo{Kind: "push"}
+	raw, err := ioutil.ReadFile(filepath.Join(runDir(runId), "run.json"))
+	if os.IsNotExist(err) {
+		return info
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, &info); err != nil {
+		log.Fatal("Unable to parse run.json of run " + runId + ", the reported error was: " + err.Error())
+	}
+	return info
+}
+
+// runTargets are the targets a run left docs on.
+func runTargets(runId string) []string {
+	entries, err := ioutil.ReadDir(runDir(runId))
+	if err != nil {
+		log.Fatal("Unable to read push run " + runId + ", the reported error was: " + err.Error())
+	}
+	var targets []string
+	for _, e := range entries {
+		if name := strings.TrimSuffix(e.Name(), ".ndjson"); !e.IsDir() && name != e.Name() {
+			targets = append(targets, name)
+		}
+	}
+	return targets
+}
+
+// latestRun is the newest push of a build in config.Runs.Dir that left
+// docs on a from target; run ids sort by time. Promotions are passed
+// over, so promoting twice in a row still starts from the build.
+func latestRun(from string) string {
+	entries, err := ioutil.ReadDir(config.Runs.Dir)
+	if err != nil {
+		log.Fatal("No push runs found, the reported error was: " + err.Error())
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	for i := len(ids) - 1; i >= 0; i-- {
+		if readRunInfo(ids[i]).Kind == "promote" {
+			continue
+		}
+		for _, target := range runTargets(ids[i]) {
+			if _, ok := promotionTarget(target, from, ""); ok {
+				return ids[i]
+			}
+		}
+	}
+	log.Fatal("No push run in " + config.Runs.Dir + " pushed to " + from)
+	return ""
+}
+
+// promotionTarget maps a target a run pushed to onto the target to promote
+// it to. from and to are either target names, or the stage suffix of names,
+// so "stage" to "prod" sends discordia-stage to discordia-prod and
+// igneous-stage to igneous-prod.
+func promotionTarget(source string, from string, to string) (string, bool) {
+	if source == from {
+		return to, true
+	}
+	if strings.HasSuffix(source, "-"+from) {
+		return strings.TrimSuffix(source, from) + to, true
+	}
+	return "", false
+}
+
+func getApprovedKeys(path string) map[string]bool {
+	rows := []ApprovedRecord{}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := gocsv.UnmarshalFile(f, &rows); err != nil {
+		panic(err)
+	}
+	keys := make(map[string]bool)
+	for _, r := range rows {
+		keys[recordKey(r.Manufacturer, r.Year, r.Model)] = true
+	}
+	return keys
+}
+
+// promoteCommand pushes the docs a run left on the -from targets to the
+// matching -to targets, without rebuilding.
+func promoteCommand(args []string) {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	from := fs.String("from", "stage", "target, or target suffix, the run pushed to")
+	to := fs.String("to", "prod", "target, or target suffix, to promote to")
+	runId := fs.String("run", "", "push run to promote, the latest when empty")
+	approved := fs.String("approved", "", "CSV of Manufacturer,Year,Model; only these records are promoted")
+	var opts pushOptions
+	fs.BoolVar(&opts.verify, "verify", false, "read every created or updated record back and compare it with what was sent")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "report what would be created or updated without sending anything")
+	fs.IntVar(&opts.workers, "workers", config.Push.Workers, "docs sent to each target at a time")
+	fs.IntVar(&opts.canary, "canary", 0, "push and read back this many representative docs before the rest")
+	fs.StringVar(&opts.canaryOnFailure, "canary-on-failure", config.Canary.OnFailure, "abort or pause when the canary fails")
+	fs.IntVar(&opts.resumeFrom, "resume-from", 0, "skip the docs before this index, as reported by an aborted promotion")
+	fs.Parse(args)
+	if opts.canaryOnFailure != "abort" && opts.canaryOnFailure != "pause" {
+		fmt.Println("-canary-on-failure must be abort or pause")
+		os.Exit(2)
+	}
+
+	if *runId == "" {
+		*runId = latestRun(*from)
+	}
+	opts.promotedFrom = *runId
+	var keys map[string]bool
+	if *approved != "" {
+		keys = getApprovedKeys(*approved)
+	}
+
+	var batches []pushBatch
+	for _, source := range runTargets(*runId) {
+		dest, ok := promotionTarget(source, *from, *to)
+		if !ok {
+			continue
+		}
+		if _, ok := config.Targets[dest]; !ok {
+			log.Fatal("No target called " + dest + " in config to promote " + source + " to")
+		}
+		all := loadSnapshot(filepath.Join(runDir(*runId), source+".ndjson")).docs
+		var docs Docs
+		for s := range all {
+			if keys != nil && !keys[docKey(all, s)] {
+				continue
+			}
+			all[s].Id = ""
+			docs = append(docs, all[s])
+		}
+		fmt.Println("promoting", len(docs), "of", len(all), "docs from", source, "to", dest)
+		batches = append(batches, pushBatch{target: dest, docs: docs})
+	}
+	if len(batches) == 0 {
+		log.Fatal("Run " + *runId + " pushed nothing to " + *from)
+	}
+	pushRun(opts, batches, nil, ObtainNebulousToken())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sink is a destination docs are pushed to. Each implementation owns its
+// payload shape, headers and error parsing, so postJson only deals with
+// outcomes.
+type Sink interface {
+	// Name is the configured target name, also the key of its push state.
+	Name() string
+	Exists(docs Docs, s int) (recordLookup, string, error)
+	Create(docs Docs, s int) SinkResult
+	Update(id string, docs Docs, s int) SinkResult
+	Delete(id string) SinkResult
+	// Get returns a stored record as generic JSON, for read-back checks.
+	Get(id string) (interface{}, error)
+	Health() error
+}
+
+// recordLister is implemented by sinks that can list every record.
+type recordLister interface {
+	List(source string) Docs
+}
+
+// deactivator is implemented by sinks that can mark a record inactive
+// instead of deleting it.
+type deactivator interface {
+	Deactivate(id string) SinkResult
+}
+
+// payloadSink is implemented by sinks that don't send the doc as is. The
+// payload is what a read-back is compared with.
+type payloadSink interface {
+	payload(docs Docs, s int) interface{}
+}
+
+// sentPayload is the body sink sends for docs[s].
+func sentPayload(sink Sink, docs Docs, s int) interface{} {
+	if p, ok := sink.(payloadSink); ok {
+		return p.payload(docs, s)
+	}
+	return docs[s]
+}
+
+// SinkResult is the outcome of one write. Status is the HTTP status line,
+// or "error" when no response came back; Err is the transport error or the
+// error the target reported.
+type SinkResult struct {
+	Status string
+	Code   int
+	Id     string
+	Body   string
+	Err    error
+}
+
+func (r SinkResult) ok() bool {
+	return r.Err == nil && r.Code >= 200 && r.Code <= 299
+}
+
+// message is what goes in the report for a failed write.
+func (r SinkResult) message() string {
+	if r.Err != nil {
+		return r.Err.Error()
+	}
+	return r.Body
+}
+
+// TargetConfig is one destination in config.Targets.
+type TargetConfig struct {
+	// Type is discordia or igneous.
+	Type string `json:"type"`
+	// Url receives POSTs; records live at <Url>/<id>.
+	Url string `json:"url"`
+	// ModelsUrl answers model lookups and listings.
+	ModelsUrl string `json:"modelsUrl"`
+}
+
+// newSink returns the configured target called name.
+func newSink(name string, nebulousToken string) Sink {
+	cfg, ok := config.Targets[name]
+	if !ok {
+		log.Fatal("No target called " + name + " in config")
+	}
+	switch cfg.Type {
+	case "discordia":
+		return &discordiaSink{name: name, cfg: cfg, token: nebulousToken}
+	case "igneous":
+		return &igneousSink{name: name, cfg: cfg, token: nebulousToken}
+	}
+	log.Fatal("Target " + name + " has unknown type " + cfg.Type)
+	return nil
+}
+
+// chooseTarget returns name, or asks for a target when it is empty.
+func chooseTarget(name string) string {
+	if name != "" {
+		return name
+	}
+	return getAPI()
+}
+
+func recordUrl(base string, id string) string {
+	return strings.TrimSuffix(base, "/") + "/" + id
+}
+
+// httpClient applies config.Target.TimeoutSeconds.
+func httpClient() *http.Client {
+	return &http.Client{Timeout: time.Duration(config.Target.TimeoutSeconds * float64(time.Second))}
+}
+
+// doRequest sends one request and reads the whole response.
+func doRequest(method string, reqUrl string, body []byte, headers map[string]string) SinkResult {
+	var reader *bytes.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, reqUrl, reader)
+	if err != nil {
+		return SinkResult{Status: "error", Err: err}
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return SinkResult{Status: "error", Err: err}
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	return SinkResult{Status: resp.Status, Code: resp.StatusCode, Body: string(bodyBytes), Err: err}
+}
+
+// decodeRecord unwraps a "data" envelope around a single record.
+func decodeRecord(r SinkResult) (interface{}, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	if r.Code < 200 || r.Code > 299 {
+		return nil, fmt.Errorf("read back returned %s", r.Status)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(r.Body), &v); err != nil {
+		return nil, err
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		if data, ok := m["data"].(map[string]interface{}); ok {
+			return data, nil
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// catalogSnapshot is a local copy of the target's models, used to resolve
+// existence and _id without a lookup per doc.
+type catalogSnapshot struct {
+	docs  Docs
+	byKey map[string]int
+}
+
+// writeSnapshot stores docs as NDJSON, one record per line.
+func writeSnapshot(path string, docs Docs) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for s := range docs {
+		line, _ := json.Marshal(docs[s])
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadSnapshot(path string) *catalogSnapshot {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	snap := &catalogSnapshot{byKey: make(map[string]int)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var one Docs
+		if err := json.Unmarshal(append(append([]byte("["), scanner.Bytes()...), ']'), &one); err != nil {
+			log.Fatal(fmt.Sprintf("Unable to parse %s line %d, the reported error was: %s", path, line, err.Error()))
+		}
+		snap.docs = append(snap.docs, one...)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	for s := range snap.docs {
+		snap.byKey[docKey(snap.docs, s)] = s
+	}
+	fmt.Println("loaded", len(snap.docs), "records from", path)
+	return snap
+}
+
+// lookup returns the _id and the content hash of the record with this
+// record key, and whether the snapshot has one.
+func (snap *catalogSnapshot) lookup(key string) (string, string, bool) {
+	s, ok := snap.byKey[key]
+	if !ok {
+		return "", "", false
+	}
+	return snap.docs[s].Id, docHash(snap.docs, s), true
+}
+
+// snapshotCommand pages through the target's models and saves them for
+// offline existence checks with "-snapshot".
+func snapshotCommand(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	out := fs.String("out", "snapshot.ndjson", "where the snapshot is written")
+	source := fs.String("source", "", "only records with this meta.source")
+	targetName := fs.String("target", "", "configured target, asked for when empty")
+	fs.Parse(args)
+
+	sink := newSink(chooseTarget(*targetName), ObtainNebulousToken())
+	lister, ok := sink.(recordLister)
+	if !ok {
+		log.Fatal("Target " + sink.Name() + " cannot list its records")
+	}
+	docs := lister.List(*source)
+	writeSnapshot(*out, docs)
+	fmt.Println("saved", len(docs), "records to", *out)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SortRule moves files whose path (relative to the source tree, "/"
+// separated) matches Pattern to Dest. Dest is a template of the pattern's
+// named groups, e.g. "{oem}/{model}/{rest}".
+type SortRule struct {
+	Pattern string `json:"pattern"`
+	Dest    string `json:"dest"`
+}
+
+// defaultSortRules reproduce the old moveImagesBasedOnManuf layout: color
+// swatches go under their OEM folder and "<prefix>_<oem>_<model>_<rest>"
+// files under oem/model.
+var defaultSortRules = []SortRule{
+	{Pattern: `^ColorSwatches/(?P<oem>[^/]+)/(?P<rest>[^/]+)$`, Dest: "{oem}/{rest}"},
+	{Pattern: `^[^/]+/[^_/]*_(?P<oem>[^_/]+)_(?P<model>[^_/]+)_(?P<rest>[^/]+)$`, Dest: "{oem}/{model}/{rest}"},
+	{Pattern: `^[^/]+/[^_/]*_(?P<oem>[^_/]+)_(?P<rest>[^_/]+)$`, Dest: "{oem}/{rest}"},
+}
+
+type compiledSortRule struct {
+	re   *regexp.Regexp
+	dest string
+}
+
+func compileSortRules(rules []SortRule) ([]compiledSortRule, error) {
+	var out []compiledSortRule
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("sort rule %q: %v", r.Pattern, err)
+		}
+		out = append(out, compiledSortRule{re: re, dest: r.Dest})
+	}
+	return out, nil
+}
+
+// sortDestination returns the templated destination of the first matching
+// rule, or "" when none matches.
+func sortDestination(rules []compiledSortRule, rel string) string {
+	for _, r := range rules {
+		m := r.re.FindStringSubmatch(rel)
+		if m == nil {
+			continue
+		}
+		dest := r.dest
+		for i, name := range r.re.SubexpNames() {
+			if name != "" {
+				dest = strings.Replace(dest, "{"+name+"}", m[i], -1)
+			}
+		}
+		return path.Clean(dest)
+	}
+	return ""
+}
+
+// renameOnCollision appends -1, -2, ... before the extension until the
+// path is not in use.
+func renameOnCollision(dest string, used map[string]string) string {
+	ext := path.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for i := 1; ; i++ {
+		candidate := base + "-" + strconv.Itoa(i) + ext
+		if _, ok := used[candidate]; !ok {
+			return candidate
+		}
+	}
+}
+
+// sortImagesCommand replaces moveImagesBasedOnManuf. It copies each file of
+// the source tree to the destination given by the first matching sort rule,
+// leaving the source untouched, and keeps going past errors.
+func sortImagesCommand(args []string) {
+	fs := flag.NewFlagSet("sort-images", flag.ExitOnError)
+	src := fs.String("src", "images_after_delete", "images to sort")
+	destDir := fs.String("dest", "sorted_images", "sorted image tree")
+	onCollision := fs.String("on-collision", "rename", "when two files sort to the same place: rename, skip or overwrite")
+	dryRun := fs.Bool("dry-run", false, "only write the manifest")
+	manifest := fs.String("manifest", "imageSort.csv", "manifest of source to destination")
+	fs.Parse(args)
+
+	if *onCollision != "rename" && *onCollision != "skip" && *onCollision != "overwrite" {
+		fmt.Println("-on-collision must be rename, skip or overwrite")
+		os.Exit(2)
+	}
+	rules, err := compileSortRules(config.ImageSorter.Rules)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	var files []string
+	if err := filepath.Walk(*src, visit(&files)); err != nil {
+		panic(err)
+	}
+
+	deleteFile(*manifest)
+	createFile(*manifest)
+	f, err := os.OpenFile(*manifest, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"Status", "Source", "Destination", "Detail"})
+
+	used := make(map[string]string)
+	link := make(map[string]int)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		rel, _ := filepath.Rel(*src, file)
+		rel = filepath.ToSlash(rel)
+		status, detail := "sorted", ""
+		dest := sortDestination(rules, rel)
+		if dest == "" {
+			status = "unmatched"
+		} else if other, ok := used[dest]; ok {
+			detail = "collides with " + other
+			switch *onCollision {
+			case "skip":
+				status = "skipped"
+			case "overwrite":
+				status = "overwritten"
+			case "rename":
+				status = "renamed"
+				dest = renameOnCollision(dest, used)
+			}
+		}
+		if dest != "" && status != "skipped" {
+			used[dest] = rel
+			if !*dryRun {
+				if err := copyImage(file, filepath.Join(*destDir, filepath.FromSlash(dest)), info); err != nil {
+					status, detail = "error", err.Error()
+				}
+			}
+		}
+		link = countStatus(status, link)
+		writer.Write([]string{status, rel, dest, detail})
+	}
+	writer.Flush()
+	for key, value := range link {
+		fmt.Println(key, value)
+	}
+}
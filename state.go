@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PushState remembers, per target name, what was last pushed for each
+// record key, so unchanged docs can be skipped and changed ones patched.
+type PushState struct {
+	Targets map[string]map[string]*RecordState `json:"targets"`
+
+	// mu guards Targets while several targets are pushed at once.
+	mu sync.Mutex
+}
+
+type RecordState struct {
+	Id       string `json:"id"`
+	Hash     string `json:"hash"`
+	PushedAt string `json:"pushedAt"`
+	// RunId is the push run that last sent the record.
+	RunId string `json:"runId,omitempty"`
+}
+
+// recordKey identifies a model across builds and targets.
+func recordKey(manufacturer string, year int, model string) string {
+	return strings.ToLower(strings.TrimSpace(manufacturer)) + "|" + strconv.Itoa(year) + "|" + strings.ToLower(strings.TrimSpace(model))
+}
+
+func docKey(docs Docs, s int) string {
+	return recordKey(docs[s].General.Manufacturer, docs[s].General.Year, docs[s].General.Model)
+}
+
+// docHash is the sha256 of the doc as it would be sent, without its _id.
+// encoding/json writes map keys sorted, so equal docs hash equally.
+func docHash(docs Docs, s int) string {
+	doc := docs[s]
+	doc.Id = ""
+	mJ, _ := json.Marshal(doc)
+	sum := sha256.Sum256(mJ)
+	return hex.EncodeToString(sum[:])
+}
+
+func loadPushState(path string) *PushState {
+	st := &PushState{Targets: make(map[string]map[string]*RecordState)}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, st); err != nil {
+		log.Fatal("Unable to parse " + path + ", the reported error was: " + err.Error())
+	}
+	if st.Targets == nil {
+		st.Targets = make(map[string]map[string]*RecordState)
+	}
+	// State files written before targets had names are keyed by url.
+	for name, t := range config.Targets {
+		if records, ok := st.Targets[t.Url]; ok && st.Targets[name] == nil {
+			st.Targets[name] = records
+			delete(st.Targets, t.Url)
+		}
+	}
+	return st
+}
+
+func (st *PushState) save(path string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out, _ := json.MarshalIndent(st, "", "  ")
+	if err := ioutil.WriteFile(path+".tmp", out, 0644); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (st *PushState) target(name string) map[string]*RecordState {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.targetLocked(name)
+}
+
+func (st *PushState) targetLocked(name string) map[string]*RecordState {
+	if st.Targets[name] == nil {
+		st.Targets[name] = make(map[string]*RecordState)
+	}
+	return st.Targets[name]
+}
+
+func (st *PushState) lookup(name string, key string) (*RecordState, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	rec, ok := st.Targets[name][key]
+	return rec, ok
+}
+
+func (st *PushState) record(name string, key string, id string, hash string, runId string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.targetLocked(name)[key] = &RecordState{Id: id, Hash: hash, PushedAt: time.Now().UTC().Format(time.RFC3339), RunId: runId}
+}
+
+// responseId pulls the created record's _id out of a POST response, which
+// is either the record itself or wrapped in "data".
+func responseId(body string) string {
+	var r struct {
+		Id   string `json:"_id"`
+		Data struct {
+			Id string `json:"_id"`
+		} `json:"data"`
+	}
+	json.Unmarshal([]byte(body), &r)
+	if r.Data.Id != "" {
+		return r.Data.Id
+	}
+	return r.Id
+}
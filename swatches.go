@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+)
+
+// Color is one paint option of a model, from the ColorSwatches images.
+type Color struct {
+	Name   string `json:"name"`
+	Swatch string `json:"swatch"`
+	Hex    string `json:"hex,omitempty"`
+}
+
+// SwatchMapping assigns a swatch file to a trim, by TrimId or by
+// Manufacturer and Model, when the file name doesn't follow the
+// "<Model>_<Color>" convention. File is relative to the swatch directory.
+type SwatchMapping struct {
+	TrimId       string `csv:"TrimId"`
+	Manufacturer string `csv:"Manufacturer"`
+	Model        string `csv:"Model"`
+	ColorName    string `csv:"ColorName"`
+	File         string `csv:"File"`
+}
+
+type swatchIndex struct {
+	dir   string
+	byOem map[string][]string
+	// models has, by normalized OEM, the model and model plus trim names
+	// of the feed, to tell which model a file name is really for.
+	models   map[string][]string
+	mappings []SwatchMapping
+	mapped   map[string]bool
+	hexCache map[string]string
+}
+
+var swatches *swatchIndex
+
+func getSwatchMappings(path string) []SwatchMapping {
+	fmt.Println("getSwatchMappings")
+	sm := []SwatchMapping{}
+
+	mappingFile, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		return sm
+	}
+	defer mappingFile.Close()
+
+	if err := gocsv.UnmarshalFile(mappingFile, &sm); err != nil {
+		panic(err)
+	}
+	return sm
+}
+
+// newSwatchIndex lists <dir>/<OEM>/<file> swatches by normalized OEM.
+func newSwatchIndex(dir string, mappings []SwatchMapping) *swatchIndex {
+	idx := &swatchIndex{dir: dir, byOem: make(map[string][]string), models: make(map[string][]string), mappings: mappings, mapped: make(map[string]bool), hexCache: make(map[string]string)}
+	for _, m := range mappings {
+		idx.mapped[filepath.ToSlash(m.File)] = true
+	}
+	var files []string
+	if _, err := os.Stat(dir); err != nil {
+		return idx
+	}
+	if err := filepath.Walk(dir, visit(&files)); err != nil {
+		panic(err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		rel, _ := filepath.Rel(dir, file)
+		rel = filepath.ToSlash(rel)
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		oem := normalizeName(parts[0])
+		idx.byOem[oem] = append(idx.byOem[oem], rel)
+	}
+	return idx
+}
+
+// addModels records the model names of the feed's trims.
+func (idx *swatchIndex) addModels(ct []CrsTrims) {
+	seen := make(map[string]bool)
+	for _, t := range ct {
+		oem := normalizeName(t.ManufacturerName)
+		for _, name := range []string{t.ModelName, t.ModelName + " " + t.TrimName} {
+			if key := oem + "|" + normalizeName(name); !seen[key] {
+				seen[key] = true
+				idx.models[oem] = append(idx.models[oem], name)
+			}
+		}
+	}
+}
+
+// swatchWords splits a swatch file name into words and returns how many
+// leading words spell model, ignoring case and separators, or 0.
+func swatchWords(file string, model string) ([]string, int) {
+	base := strings.TrimSuffix(path.Base(file), path.Ext(file))
+	words := strings.FieldsFunc(base, func(r rune) bool { return r == '_' || r == ' ' || r == '-' })
+	target := normalizeName(model)
+	if target == "" {
+		return words, 0
+	}
+	prefix := ""
+	for i, w := range words {
+		prefix += normalizeName(w)
+		if prefix == target {
+			return words, i + 1
+		}
+		if !strings.HasPrefix(target, prefix) {
+			break
+		}
+	}
+	return words, 0
+}
+
+// colorFromName returns the color part of a "<Model>_<Color>" swatch file
+// name when its leading words spell model, ignoring case and separators.
+func colorFromName(file string, model string) (string, bool) {
+	words, n := swatchWords(file, model)
+	if n == 0 || n == len(words) {
+		return "", false
+	}
+	return strings.Join(words[n:], " "), true
+}
+
+// longerModel reports whether another model of the OEM spells more of the
+// file name than n words, so Sportsman_570_Red.jpg isn't taken as the
+// "570 Red" color of the Sportsman.
+func (idx *swatchIndex) longerModel(oem string, file string, n int) bool {
+	for _, model := range idx.models[oem] {
+		if _, m := swatchWords(file, model); m > n {
+			return true
+		}
+	}
+	return false
+}
+
+// colorsFor returns the swatches of a trim: mapping file rows first, then
+// files named after the TrimId, model and trim, or model. Files listed in
+// the mapping file are only ever assigned through it.
+func (idx *swatchIndex) colorsFor(trimId string, manufacturer string, modelName string, trimName string) []Color {
+	var colors []Color
+	seen := make(map[string]bool)
+	add := func(name string, rel string) {
+		if seen[rel] {
+			return
+		}
+		seen[rel] = true
+		c := Color{Name: name, Swatch: imageUrl(config.Swatches.Folder, rel)}
+		c.Hex = idx.hex(rel)
+		colors = append(colors, c)
+	}
+
+	for _, m := range idx.mappings {
+		if (m.TrimId != "" && m.TrimId == trimId) ||
+			(m.TrimId == "" && strings.EqualFold(m.Manufacturer, manufacturer) && strings.EqualFold(m.Model, modelName)) {
+			add(m.ColorName, filepath.ToSlash(m.File))
+		}
+	}
+	oem := normalizeName(manufacturer)
+	for _, rel := range idx.byOem[oem] {
+		if idx.mapped[rel] {
+			continue
+		}
+		for _, key := range []string{trimId, modelName + " " + trimName, modelName} {
+			if name, ok := colorFromName(rel, key); ok {
+				if _, n := swatchWords(rel, key); !idx.longerModel(oem, rel, n) {
+					add(name, rel)
+				}
+				break
+			}
+		}
+	}
+	return colors
+}
+
+// hex returns the dominant color of a swatch as #rrggbb, or "" when the
+// file can't be decoded. Pixels are bucketed at 4 bits per channel and the
+// fullest bucket is averaged; transparent pixels are ignored.
+func (idx *swatchIndex) hex(rel string) string {
+	if h, ok := idx.hexCache[rel]; ok {
+		return h
+	}
+	h := ""
+	if f, err := os.Open(filepath.Join(idx.dir, filepath.FromSlash(rel))); err == nil {
+		if img, _, err := image.Decode(f); err == nil {
+			h = dominantColor(img)
+		}
+		f.Close()
+	}
+	idx.hexCache[rel] = h
+	return h
+}
+
+func dominantColor(img image.Image) string {
+	type bucket struct{ r, g, b, n uint64 }
+	buckets := make(map[uint32]*bucket)
+	var best *bucket
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			r, g, bl = r>>8, g>>8, bl>>8
+			key := (r>>4)<<8 | (g>>4)<<4 | bl>>4
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += uint64(r)
+			bk.g += uint64(g)
+			bk.b += uint64(bl)
+			bk.n++
+			if best == nil || bk.n > best.n {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
+
+// getColors returns the swatches of ct[t]; ct is every trim being built.
+func getColors(ct []CrsTrims, t int) []Color {
+	if swatches == nil {
+		swatches = newSwatchIndex(config.Swatches.Dir, getSwatchMappings(config.Swatches.MappingFile))
+		swatches.addModels(ct)
+	}
+	return swatches.colorsFor(ct[t].TrimId, ct[t].ManufacturerName, ct[t].ModelName, ct[t].TrimName)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwatchesOfShorterModelSkipLongerModelFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"Sportsman_Blue.png", "Sportsman_570_Red.png"} {
+		if err := os.MkdirAll(filepath.Join(dir, "Polaris"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "Polaris", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx := newSwatchIndex(dir, nil)
+	idx.addModels([]CrsTrims{
+		{ManufacturerName: "Polaris", ModelName: "Sportsman", TrimName: "ETX", TrimId: "1"},
+		{ManufacturerName: "Polaris", ModelName: "Sportsman 570", TrimName: "EPS", TrimId: "2"},
+	})
+
+	colors := idx.colorsFor("1", "Polaris", "Sportsman", "ETX")
+	if len(colors) != 1 || colors[0].Name != "Blue" {
+		t.Fatalf("Sportsman colors = %+v, want only Blue", colors)
+	}
+	colors = idx.colorsFor("2", "Polaris", "Sportsman 570", "EPS")
+	if len(colors) != 1 || colors[0].Name != "Red" {
+		t.Fatalf("Sportsman 570 colors = %+v, want only Red", colors)
+	}
+}
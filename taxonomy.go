@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/gocarina/gocsv"
+)
+
+// Taxonomy is the target's category tree: category -> set of subcategories.
+type Taxonomy map[string]map[string]bool
+
+type TaxonomyRow struct {
+	Category    string `csv:"Category"`
+	Subcategory string `csv:"Subcategory"`
+}
+
+// TaxonomyResponse is the shape returned by the target's category endpoint.
+type TaxonomyResponse struct {
+	Data []struct {
+		Category      string   `json:"category"`
+		Subcategories []string `json:"subcategories"`
+	} `json:"data"`
+}
+
+// TaxonomyIssue is one line of unmappedCategories.csv.
+type TaxonomyIssue struct {
+	TrimId       string
+	Manufacturer string
+	Model        string
+	ProdType     string
+	GenericType  string
+	Category     string
+	Subcategory  string
+	Reason       string
+}
+
+func (tx Taxonomy) add(category string, subcategory string) {
+	if category == "" {
+		return
+	}
+	if tx[category] == nil {
+		tx[category] = make(map[string]bool)
+	}
+	if subcategory != "" {
+		tx[category][subcategory] = true
+	}
+}
+
+// validate returns an empty string when category/subcategory exist in the
+// tree. A subcategory equal to its category is accepted, as that is what
+// buildJson falls back to when the feed has no "Generic Type 2".
+func (tx Taxonomy) validate(category string, subcategory string) string {
+	if category == "" {
+		return "no category mapping"
+	}
+	subs, ok := tx[category]
+	if !ok {
+		return "category not in taxonomy"
+	}
+	if subcategory != category && !subs[subcategory] {
+		return "subcategory not in taxonomy"
+	}
+	return ""
+}
+
+// loadTaxonomy fetches the tree from config.Taxonomy.Url when set, otherwise
+// reads config.Taxonomy.File. It returns nil when neither is available, in
+// which case docs are only checked for a missing mapping.
+func loadTaxonomy() Taxonomy {
+	if config.Taxonomy.Url != "" {
+		return fetchTaxonomy(config.Taxonomy.Url, ObtainNebulousToken())
+	}
+	return getTaxonomyFromFile(config.Taxonomy.File)
+}
+
+func getTaxonomyFromFile(path string) Taxonomy {
+	fmt.Println("getTaxonomyFromFile")
+	rows := []TaxonomyRow{}
+
+	taxonomyFile, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	defer taxonomyFile.Close()
+
+	if err := gocsv.UnmarshalFile(taxonomyFile, &rows); err != nil {
+		panic(err)
+	}
+	tx := make(Taxonomy)
+	for _, r := range rows {
+		tx.add(r.Category, r.Subcategory)
+	}
+	return tx
+}
+
+func fetchTaxonomy(taxonomyUrl string, nebulousToken string) Taxonomy {
+	req, err := http.NewRequest("GET", taxonomyUrl, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", nebulousToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal("Unable to fetch the category taxonomy, the reported error was: " + err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatal("Unable to fetch the category taxonomy, the response status was: " + resp.Status)
+	}
+	var tr TaxonomyResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		log.Fatal("Unable to decode the category taxonomy, the reported error was: " + err.Error())
+	}
+	tx := make(Taxonomy)
+	for _, c := range tr.Data {
+		tx.add(c.Category, "")
+		for _, sub := range c.Subcategories {
+			tx.add(c.Category, sub)
+		}
+	}
+	return tx
+}
+
+// categoryMapping resolves a CRS "Generic Type (Primary)" value to the
+// target category. A per-TrimId row wins; otherwise the most common mapping
+// for the same ProdType and Value is used.
+type categoryMapping struct {
+	byTrim     map[string]string
+	byProdType map[string]string
+}
+
+func newCategoryMapping(ca []CrsCategories) *categoryMapping {
+	m := &categoryMapping{
+		byTrim:     make(map[string]string),
+		byProdType: make(map[string]string),
+	}
+	votes := make(map[string]map[string]int)
+	for _, c := range ca {
+		if c.MappedCategory == "" {
+			continue
+		}
+		m.byTrim[c.Value+"|"+c.TrimId] = c.MappedCategory
+		if c.ProdType == "" {
+			continue
+		}
+		key := c.ProdType + "|" + c.Value
+		if votes[key] == nil {
+			votes[key] = make(map[string]int)
+		}
+		votes[key][c.MappedCategory]++
+	}
+	for key, counts := range votes {
+		best := ""
+		for cat, n := range counts {
+			if best == "" || n > counts[best] || (n == counts[best] && cat < best) {
+				best = cat
+			}
+		}
+		m.byProdType[key] = best
+	}
+	return m
+}
+
+func (m *categoryMapping) lookup(value string, trimId string, prodType string) string {
+	if cat, ok := m.byTrim[value+"|"+trimId]; ok {
+		return cat
+	}
+	return m.byProdType[prodType+"|"+value]
+}
+
+func writeTaxonomyReport(path string, issues []TaxonomyIssue) {
+	deleteFile(path)
+	if len(issues) == 0 {
+		return
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].TrimId < issues[j].TrimId })
+
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"TrimId", "Manufacturer", "Model", "ProdType", "GenericType", "Category", "Subcategory", "Reason"})
+	for _, i := range issues {
+		writer.Write([]string{i.TrimId, i.Manufacturer, i.Model, i.ProdType, i.GenericType, i.Category, i.Subcategory, i.Reason})
+	}
+	writer.Flush()
+	fmt.Println(len(issues), "trims have category problems, see", path)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the subset of JSON Schema (draft-07) that docSchema generates
+// and validateSchema checks.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	PropertyNames        *Schema            `json:"propertyNames,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+}
+
+// QuarantinedDoc is one entry of the quarantine file.
+type QuarantinedDoc struct {
+	Reasons []string        `json:"reasons"`
+	Doc     json.RawMessage `json:"doc"`
+}
+
+// schemaForType mirrors how encoding/json marshals t: fields without
+// omitempty are required, and slices and maps without it may be null.
+func schemaForType(t reflect.Type) *Schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: []string{"array", "null"}, Items: schemaForType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: []string{"object", "null"}, AdditionalProperties: schemaForType(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			if tag[0] == "-" {
+				continue
+			}
+			if tag[0] != "" {
+				name = tag[0]
+			}
+			s.Properties[name] = schemaForType(f.Type)
+			omitempty := false
+			for _, opt := range tag[1:] {
+				omitempty = omitempty || opt == "omitempty"
+			}
+			if !omitempty {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return s
+	}
+	return &Schema{}
+}
+
+// docSchema is the schema of one element of Docs with the business rules
+// a doc must meet before it is pushed. categories, when not nil, is the
+// list of known categories.
+func docSchema(categories []string) *Schema {
+	s := schemaForType(reflect.TypeOf(Docs{}).Elem())
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+
+	one := 1
+	general := s.Properties["general"]
+	for _, field := range []string{"manufacturer", "model", "category"} {
+		general.Properties[field].MinLength = &one
+	}
+	minYear := float64(config.Validation.MinYear)
+	maxYear := float64(config.Validation.MaxYear)
+	if maxYear == 0 {
+		maxYear = float64(time.Now().Year() + 2)
+	}
+	general.Properties["year"].Minimum = &minYear
+	general.Properties["year"].Maximum = &maxYear
+	zero := 0.0
+	general.Properties["msrp"].ExclusiveMinimum = &zero
+	if categories != nil {
+		for _, c := range categories {
+			general.Properties["category"].Enum = append(general.Properties["category"].Enum, c)
+		}
+	}
+
+	for _, prop := range s.Properties {
+		if prop.AdditionalProperties != nil && prop.AdditionalProperties.Properties["label"] != nil {
+			prop.PropertyNames = &Schema{Type: "string", MinLength: &one}
+		}
+	}
+	return s
+}
+
+func jsonType(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if n == float64(int64(n)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+func typeAllowed(schemaType interface{}, actual string) bool {
+	var allowed []string
+	switch t := schemaType.(type) {
+	case nil:
+		return true
+	case string:
+		allowed = []string{t}
+	case []string:
+		allowed = t
+	case []interface{}:
+		for _, a := range t {
+			allowed = append(allowed, fmt.Sprint(a))
+		}
+	}
+	for _, a := range allowed {
+		if a == actual || (a == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSchema returns one reason per violation, prefixed with the path
+// of the offending value.
+func validateSchema(s *Schema, v interface{}, path string) []string {
+	var reasons []string
+	fail := func(msg string) { reasons = append(reasons, path+": "+msg) }
+
+	actual := jsonType(v)
+	if !typeAllowed(s.Type, actual) {
+		fail(fmt.Sprintf("expected %v, got %s", s.Type, actual))
+		return reasons
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			fail(fmt.Sprintf("%v is not a known value", v))
+		}
+	}
+	switch val := v.(type) {
+	case string:
+		if s.MinLength != nil && len(val) < *s.MinLength {
+			fail("must not be empty")
+		}
+	case float64:
+		if s.Minimum != nil && val < *s.Minimum {
+			fail(fmt.Sprintf("%v is below %v", val, *s.Minimum))
+		}
+		if s.Maximum != nil && val > *s.Maximum {
+			fail(fmt.Sprintf("%v is above %v", val, *s.Maximum))
+		}
+		if s.ExclusiveMinimum != nil && val <= *s.ExclusiveMinimum {
+			fail(fmt.Sprintf("must be greater than %v", *s.ExclusiveMinimum))
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range val {
+				reasons = append(reasons, validateSchema(s.Items, item, path+"["+strconv.Itoa(i)+"]")...)
+			}
+		}
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := val[r]; !ok {
+				fail("missing " + r)
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if s.PropertyNames != nil {
+				reasons = append(reasons, validateSchema(s.PropertyNames, k, path+" key "+strconv.Quote(k))...)
+			}
+			if prop, ok := s.Properties[k]; ok {
+				reasons = append(reasons, validateSchema(prop, val[k], path+"."+k)...)
+			} else if s.AdditionalProperties != nil {
+				reasons = append(reasons, validateSchema(s.AdditionalProperties, val[k], path+"."+k)...)
+			}
+		}
+	}
+	return reasons
+}
+
+func taxonomyCategories(tx Taxonomy) []string {
+	if tx == nil {
+		return nil
+	}
+	categories := make([]string, 0, len(tx))
+	for c := range tx {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// validateDocs returns the docs that pass docSchema and writes the rest,
+// with their reasons, to the quarantine file. Quarantined docs are never
+// pushed.
+func validateDocs(docs Docs, tx Taxonomy, quarantinePath string) Docs {
+	schema := docSchema(taxonomyCategories(tx))
+	valid := make(Docs, 0, len(docs))
+	quarantine := []QuarantinedDoc{}
+	for s := range docs {
+		mJ, _ := json.Marshal(docs[s])
+		var v interface{}
+		json.Unmarshal(mJ, &v)
+		reasons := validateSchema(schema, v, "doc")
+		if len(reasons) == 0 {
+			valid = append(valid, docs[s])
+			continue
+		}
+		quarantine = append(quarantine, QuarantinedDoc{Reasons: reasons, Doc: mJ})
+	}
+	out, _ := json.MarshalIndent(quarantine, "", "  ")
+	if err := ioutil.WriteFile(quarantinePath, out, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(len(valid), "docs valid,", len(quarantine), "quarantined in", quarantinePath)
+	return valid
+}
+
+// validateCommand checks a docs file without pushing it, and can write the
+// generated schema for other tools.
+func validateCommand(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	docsPath := fs.String("docs", "out.json", "built docs to check")
+	quarantine := fs.String("quarantine", config.Validation.Quarantine, "where invalid docs are written")
+	schemaOut := fs.String("schema", "", "also write the JSON Schema to this file")
+	filterFlags := addTrimFilterFlags(fs)
+	fs.Parse(args)
+	selection = filterFlags.filter()
+
+	tx := loadTaxonomy()
+	if *schemaOut != "" {
+		out, _ := json.MarshalIndent(docSchema(taxonomyCategories(tx)), "", "  ")
+		if err := ioutil.WriteFile(*schemaOut, out, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	validateDocs(selection.docs(getDocs(*docsPath)), tx, *quarantine)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pushedDoc is a doc the target accepted in this run, with the _id it
+// lives under.
+type pushedDoc struct {
+	index int
+	id    string
+}
+
+// VerifyMismatch is one line of the verification report.
+type VerifyMismatch struct {
+	Path     string
+	Problem  string
+	Sent     string
+	Received string
+}
+
+func jsonText(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// compareSent walks every value of the sent doc and reports the ones the
+// target dropped, truncated or changed. Fields the target adds are ignored.
+func compareSent(sent interface{}, received interface{}, path string) []VerifyMismatch {
+	switch s := sent.(type) {
+	case map[string]interface{}:
+		r, ok := received.(map[string]interface{})
+		if !ok {
+			return []VerifyMismatch{{Path: path, Problem: "changed", Sent: jsonText(sent), Received: jsonText(received)}}
+		}
+		keys := make([]string, 0, len(s))
+		for k := range s {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var out []VerifyMismatch
+		for _, k := range keys {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			if k == "_id" {
+				continue
+			}
+			rv, ok := r[k]
+			if !ok {
+				if s[k] != nil && !isEmptyJson(s[k]) {
+					out = append(out, VerifyMismatch{Path: child, Problem: "dropped", Sent: jsonText(s[k])})
+				}
+				continue
+			}
+			out = append(out, compareSent(s[k], rv, child)...)
+		}
+		return out
+	case []interface{}:
+		r, ok := received.([]interface{})
+		if !ok || len(r) != len(s) {
+			return []VerifyMismatch{{Path: path, Problem: "changed", Sent: jsonText(sent), Received: jsonText(received)}}
+		}
+		var out []VerifyMismatch
+		for i := range s {
+			out = append(out, compareSent(s[i], r[i], path+"["+strconv.Itoa(i)+"]")...)
+		}
+		return out
+	case string:
+		if r, ok := received.(string); ok && r != s && len(r) < len(s) && strings.HasPrefix(s, r) {
+			return []VerifyMismatch{{Path: path, Problem: "truncated", Sent: s, Received: r}}
+		}
+	}
+	if !reflect.DeepEqual(sent, received) {
+		return []VerifyMismatch{{Path: path, Problem: "changed", Sent: jsonText(sent), Received: jsonText(received)}}
+	}
+	return nil
+}
+
+func isEmptyJson(v interface{}) bool {
+	switch val := v.(type) {
+	case string:
+		return val == ""
+	case []interface{}:
+		return len(val) == 0
+	case map[string]interface{}:
+		return len(val) == 0
+	}
+	return false
+}
+
+// verifyPushed re-fetches every pushed doc, compares it with what was sent
+// and appends mismatches to the report. It returns how many docs were
+// checked and how many did not come back as sent.
+func verifyPushed(sink Sink, docs Docs, pushed []pushedDoc, reportPath string) (int, int) {
+	newReport := false
+	if _, err := os.Stat(reportPath); os.IsNotExist(err) {
+		newReport = true
+	}
+	f, err := os.OpenFile(reportPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	if newReport {
+		writer.Write([]string{"Target", "Manufacturer", "Year", "Model", "Id", "Path", "Problem", "Sent", "Received"})
+	}
+
+	failed := 0
+	for _, p := range pushed {
+		doc := docs[p.index]
+		row := func(m VerifyMismatch) {
+			writer.Write([]string{sink.Name(), doc.General.Manufacturer, strconv.Itoa(doc.General.Year), doc.General.Model, p.id, m.Path, m.Problem, m.Sent, m.Received})
+		}
+		if p.id == "" {
+			failed++
+			row(VerifyMismatch{Problem: "no _id returned by the target"})
+			continue
+		}
+		received, err := sink.Get(p.id)
+		if err != nil {
+			failed++
+			row(VerifyMismatch{Problem: err.Error()})
+			continue
+		}
+		mJ, _ := json.Marshal(sentPayload(sink, docs, p.index))
+		var sent interface{}
+		json.Unmarshal(mJ, &sent)
+		mismatches := compareSent(sent, received, "")
+		if len(mismatches) > 0 {
+			failed++
+		}
+		for _, m := range mismatches {
+			row(m)
+		}
+		writer.Flush()
+	}
+	writer.Flush()
+	fmt.Println("verified", len(pushed), sink.Name(), "docs,", failed, "did not read back as sent")
+	return len(pushed), failed
+}
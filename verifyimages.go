@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Image reference statuses written to imageVerification.csv.
+const (
+	imageOk           = "ok"
+	imageBroken       = "broken"
+	imageCaseMismatch = "case-mismatch"
+	imageRemoteBroken = "remote-broken"
+	imageOrphan       = "orphan"
+)
+
+// localImageIndex indexes an image tree by relative path and by file name,
+// both exactly and lower-cased. A file sort-images renamed is also indexed
+// by the name it had before, which is the name CRS uses.
+type localImageIndex struct {
+	paths     map[string]bool
+	names     map[string][]string
+	lowerKeys map[string][]string
+	used      map[string]bool
+}
+
+func indexLocalImages(dir string, sortManifest string) *localImageIndex {
+	sources := readSortSources(sortManifest)
+	idx := &localImageIndex{
+		paths:     make(map[string]bool),
+		names:     make(map[string][]string),
+		lowerKeys: make(map[string][]string),
+		used:      make(map[string]bool),
+	}
+	var files []string
+	if err := filepath.Walk(dir, visit(&files)); err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		rel, _ := filepath.Rel(dir, file)
+		rel = filepath.ToSlash(rel)
+		idx.paths[rel] = true
+		names := []string{path.Base(rel)}
+		if source, ok := sources[rel]; ok && path.Base(source) != names[0] {
+			names = append(names, path.Base(source))
+		}
+		for _, name := range names {
+			idx.names[name] = append(idx.names[name], rel)
+			idx.lowerKeys[strings.ToLower(name)] = append(idx.lowerKeys[strings.ToLower(name)], rel)
+		}
+	}
+	return idx
+}
+
+// resolve looks for the file behind a CDN reference, first at the same
+// folder/name path, then anywhere in the tree by file name.
+func (idx *localImageIndex) resolve(ref string) (string, string) {
+	if idx.paths[ref] {
+		idx.used[ref] = true
+		return imageOk, ref
+	}
+	name := path.Base(ref)
+	if found := idx.names[name]; len(found) > 0 {
+		for _, f := range found {
+			idx.used[f] = true
+		}
+		return imageOk, found[0]
+	}
+	if found := idx.lowerKeys[strings.ToLower(name)]; len(found) > 0 {
+		for _, f := range found {
+			idx.used[f] = true
+		}
+		return imageCaseMismatch, found[0]
+	}
+	return imageBroken, ""
+}
+
+// imageRef returns the folder/name path of a CDN image link relative to
+// config.Images.BaseUrl, unescaped.
+func imageRef(src string) string {
+	ref := strings.TrimPrefix(src, config.Images.BaseUrl)
+	if unescaped, err := neturl.PathUnescape(ref); err == nil {
+		ref = unescaped
+	}
+	return strings.TrimPrefix(ref, "/")
+}
+
+func headImage(src string, host string) bool {
+	if host != "" {
+		src = strings.TrimSuffix(host, "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(src, config.Images.BaseUrl), "/")
+	}
+	resp, err := httpClient().Head(src)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// verifyImagesCommand cross-references every Images.Src of a built docs
+// file against a local image tree and reports broken references, case
+// mismatches and image files no trim uses.
+func verifyImagesCommand(args []string) {
+	fs := flag.NewFlagSet("verify-images", flag.ExitOnError)
+	docsPath := fs.String("docs", "out.json", "built docs to check")
+	dir := fs.String("dir", "sorted_images", "local image tree")
+	sortManifest := fs.String("sort-manifest", "imageSort.csv", "sort-images manifest, for the names files had before sorting")
+	head := fs.Bool("head", false, "also send a HEAD request for every image")
+	host := fs.String("host", "", "host to send HEAD requests to instead of images.baseUrl")
+	drop := fs.Bool("drop", false, "remove broken, case-mismatched and, with -head, remotely broken images from the docs file")
+	report := fs.String("report", "imageVerification.csv", "report file")
+	fs.Parse(args)
+
+	docs := getDocs(*docsPath)
+	idx := indexLocalImages(*dir, *sortManifest)
+
+	deleteFile(*report)
+	createFile(*report)
+	f, err := os.OpenFile(*report, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Write([]string{"Status", "Manufacturer", "Year", "Model", "Src", "LocalPath"})
+
+	link := make(map[string]int)
+	for s := range docs {
+		var kept []Image
+		for _, img := range docs[s].Images {
+			status, local := idx.resolve(imageRef(img.Src))
+			if status == imageOk && *head && !headImage(img.Src, *host) {
+				status = imageRemoteBroken
+			}
+			link = countStatus(status, link)
+			if status != imageOk {
+				writer.Write([]string{status, docs[s].General.Manufacturer, strconv.Itoa(docs[s].General.Year), docs[s].General.Model, img.Src, local})
+			}
+			if status == imageOk {
+				kept = append(kept, img)
+			}
+		}
+		if *drop {
+			docs[s].Images = kept
+		}
+	}
+
+	var orphans []string
+	for p := range idx.paths {
+		if !idx.used[p] {
+			orphans = append(orphans, p)
+		}
+	}
+	sort.Strings(orphans)
+	for _, p := range orphans {
+		link = countStatus(imageOrphan, link)
+		writer.Write([]string{imageOrphan, "", "", "", "", p})
+	}
+	writer.Flush()
+
+	if *drop {
+		out, _ := json.Marshal(docs)
+		if err := ioutil.WriteFile(*docsPath, out, 0644); err != nil {
+			fmt.Println(err)
+		}
+	}
+	for key, value := range link {
+		fmt.Println(key, value)
+	}
+}